@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+// albumBufferTimeout is how long an album waits for its next message before it is handled as a unit
+const albumBufferTimeout = 3 * time.Second
+
+// albumShutdownTimeout is how long pending albums are handled for on shutdown
+const albumShutdownTimeout = 10 * time.Second
+
+type albumKey struct {
+	ChatID       int64
+	MediaGroupID string
+}
+
+// isAlbumSibling tells that the match is another message of the same album, an album is never a repost of itself
+func isAlbumSibling(message *tg.Message, match *Message) bool {
+	return message.MediaGroupID != "" && match.Raw.MediaGroupID == message.MediaGroupID
+}
+
+type albumItem struct {
+	Message  *tg.Message
+	Original *Message
+}
+
+type pendingAlbum struct {
+	Key        albumKey
+	Items      []*albumItem
+	LastUpdate time.Time
+}
+
+// addAlbumItem buffers an album message; original is the matched message, if any.
+// Albums are only touched from the update loop, so no locking is needed.
+// Pending albums are kept in memory only: they are flushed on shutdown, but a crash loses their reactions and reply.
+func (r *UpdateHandler) addAlbumItem(message *tg.Message, original *Message) {
+	key := albumKey{
+		ChatID:       message.Chat.ID,
+		MediaGroupID: message.MediaGroupID,
+	}
+
+	album, ok := r.albums[key]
+	if !ok {
+		album = &pendingAlbum{
+			Key: key,
+		}
+		r.albums[key] = album
+	}
+	album.LastUpdate = time.Now()
+
+	for _, item := range album.Items {
+		if item.Message.MessageID != message.MessageID {
+			continue
+		}
+		if original != nil {
+			item.Original = original
+		}
+		return
+	}
+
+	album.Items = append(album.Items, &albumItem{
+		Message:  message,
+		Original: original,
+	})
+}
+
+// flushAlbums handles albums that have had no new messages for idle, 0 flushes all of them
+func (r *UpdateHandler) flushAlbums(ctx context.Context, idle time.Duration) {
+	for key, album := range r.albums {
+		if time.Since(album.LastUpdate) < idle {
+			continue
+		}
+		delete(r.albums, key)
+
+		err := r.storage.ExecWithTx(ctx, func(ctx context.Context, storage Storage) error {
+			return r.handleAlbum(ctx, storage, album)
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "unable to handle album",
+				slog.String("err", err.Error()),
+				slog.Int64("chat_id", key.ChatID),
+				slog.String("media_group_id", key.MediaGroupID),
+			)
+		}
+	}
+}
+
+func (r *UpdateHandler) handleAlbum(ctx context.Context, storage Storage, album *pendingAlbum) error {
+	reposts := []*albumItem{}
+	for _, item := range album.Items {
+		if item.Original != nil {
+			reposts = append(reposts, item)
+		}
+	}
+
+	if len(reposts) == 0 {
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, album.Key.ChatID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	for _, item := range reposts {
+		verdict := classifyRepost(chatSettings, item.Original, item.Message.Time())
+		err = r.sendReaction(ctx, storage, album.Key.ChatID, item.Message.MessageID, verdict.emoji())
+		if err != nil {
+			return fmt.Errorf("unable to send stale meme reaction: %w", err)
+		}
+	}
+
+	slices.SortFunc(reposts, func(a, b *albumItem) int {
+		return a.Original.CreatedAt.Compare(b.Original.CreatedAt)
+	})
+	firstOriginal := reposts[0].Original
+
+	wholeAlbum, err := r.isWholeAlbumRepost(ctx, storage, album, reposts)
+	if err != nil {
+		return fmt.Errorf("unable to check whole album repost: %w", err)
+	}
+
+	text := fmt.Sprintf("баянов в альбоме: %d из %d", len(reposts), len(album.Items))
+	if wholeAlbum {
+		text = "весь альбом уже был"
+	}
+
+	replyID, _, err := r.replyToOrigin(ctx, storage, album.Key.ChatID, reposts[0].Message.MessageID, firstOriginal, text)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to send stale album reply: %w", err)
+	}
+	if err != nil {
+		return nil
+	}
+
+	go func() {
+		select {
+		case <-time.After(deleteAutoReplyTimeout):
+		case <-ctx.Done():
+		}
+		err := r.deleteMessage(ctx, album.Key.ChatID, replyID)
+		if err != nil {
+			slog.ErrorContext(ctx, "unable to delete reply", slog.String("err", err.Error()))
+		}
+	}()
+
+	return nil
+}
+
+// isWholeAlbumRepost reports whether every message of the album matches a distinct message of one earlier album
+// and that album has no other memes, regardless of the order.
+func (r *UpdateHandler) isWholeAlbumRepost(ctx context.Context, storage Storage, album *pendingAlbum, reposts []*albumItem) (bool, error) {
+	if len(reposts) != len(album.Items) {
+		return false, nil
+	}
+
+	origMediaGroupID := reposts[0].Original.Raw.MediaGroupID
+	if origMediaGroupID == "" || origMediaGroupID == album.Key.MediaGroupID {
+		return false, nil
+	}
+
+	origIDs := map[int]struct{}{}
+	for _, item := range reposts {
+		if item.Original.Raw.MediaGroupID != origMediaGroupID {
+			return false, nil
+		}
+		origIDs[item.Original.MessageID] = struct{}{}
+	}
+	if len(origIDs) != len(reposts) {
+		return false, nil
+	}
+
+	origAlbum, err := storage.ListMediaGroupMessages(ctx, album.Key.ChatID, origMediaGroupID)
+	if err != nil {
+		return false, fmt.Errorf("unable to list original album messages: %w", err)
+	}
+
+	return len(origAlbum) == len(origIDs), nil
+}
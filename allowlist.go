@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+// handleAllow adds the replied meme to the allow-list, its whole cluster may be reposted from now on
+func (r *UpdateHandler) handleAllow(ctx context.Context, storage Storage, message *tg.Message) error {
+	if message.ReplyToMessage == nil {
+		err := r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_reply", r.assets.GetAudioNoRererence())
+		if err != nil {
+			return fmt.Errorf("unable to send no_reply voice message %w", err)
+		}
+		return nil
+	}
+
+	_, err := storage.GetMessage(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get message: %w", err)
+	}
+	if err != nil {
+		err = r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_repeat", r.assets.GetAudioNoRepeat())
+		if err != nil {
+			return fmt.Errorf("unable to send no_repeat voice message %w", err)
+		}
+		return nil
+	}
+
+	// messages matched only by stickers have no cluster until they are reposted
+	err = storage.CreateMemeCluster(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil {
+		return fmt.Errorf("unable to create meme cluster: %w", err)
+	}
+
+	err = storage.UpsertAllowedMeme(ctx, AllowedMeme{
+		ChatID:    message.Chat.ID,
+		MessageID: message.ReplyToMessage.MessageID,
+		AuthorID:  message.From.ID,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save allowed meme: %w", err)
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "этот мем можно повторять")
+	if err != nil {
+		return fmt.Errorf("unable to send allowed reply: %w", err)
+	}
+
+	return nil
+}
+
+// handleDisallow removes every allow-list entry of the cluster of the replied meme
+func (r *UpdateHandler) handleDisallow(ctx context.Context, storage Storage, message *tg.Message) error {
+	if message.ReplyToMessage == nil {
+		err := r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_reply", r.assets.GetAudioNoRererence())
+		if err != nil {
+			return fmt.Errorf("unable to send no_reply voice message %w", err)
+		}
+		return nil
+	}
+
+	deleted, err := storage.DeleteAllowedMemes(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil {
+		return fmt.Errorf("unable to delete allowed memes: %w", err)
+	}
+
+	replyText := "этот мем больше нельзя повторять"
+	if deleted == 0 {
+		replyText = "этого мема нет в списке разрешенных"
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, replyText)
+	if err != nil {
+		return fmt.Errorf("unable to send disallowed reply: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleAllowlist(ctx context.Context, storage Storage, message *tg.Message) error {
+	memes, err := storage.ListAllowedMemes(ctx, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to list allowed memes: %w", err)
+	}
+
+	if len(memes) == 0 {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "разрешенных мемов нет")
+		if err != nil {
+			return fmt.Errorf("unable to send empty allowlist reply: %w", err)
+		}
+		return nil
+	}
+
+	var text strings.Builder
+	text.WriteString("Мемы, которые можно повторять:")
+	for i, meme := range memes {
+		fmt.Fprintf(&text, "\n%d. %s - с %s",
+			i+1,
+			messageLink(message.Chat, meme.MessageID),
+			meme.CreatedAt.Format("02.01.2006"),
+		)
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, text.String())
+	if err != nil {
+		return fmt.Errorf("unable to send allowlist reply: %w", err)
+	}
+
+	return nil
+}
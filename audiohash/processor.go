@@ -1,26 +1,85 @@
 package audiohash
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
 
+	nativechromaprint "github.com/NinaLeven/MemePolice/chromaprint"
 	"github.com/NinaLeven/MemePolice/ffmpeg"
 	"github.com/NinaLeven/MemePolice/fsutils"
 	"github.com/corona10/goimagehash"
 	"github.com/go-fingerprint/fingerprint"
 	"github.com/google/uuid"
-	"github.com/jo-hoe/chromaprint"
 )
 
-func PerceptualHash(audioPath string) (uint64, error) {
+const maxFingerprintSeconds = 60
+
+const (
+	FingerprinterFpcalc = "fpcalc"
+	FingerprinterNative = "native"
+)
+
+// Fingerprinter is the configured chromaprint implementation: fpcalc by default, the experimental
+// native fingerprinter is chosen with AUDIO_FINGERPRINTER=native. It matches fpcalc on the same PCM,
+// but it is fed PCM decoded by ffmpeg rather than by fpcalc, so hashes of compressed audio may differ.
+func Fingerprinter() string {
+	if os.Getenv("AUDIO_FINGERPRINTER") == FingerprinterNative {
+		return FingerprinterNative
+	}
+	return FingerprinterFpcalc
+}
+
+// rawFingerprint calculates chromaprint of the audio with the configured fingerprinter
+func rawFingerprint(ctx context.Context, audioPath string) ([]int32, error) {
+	if Fingerprinter() == FingerprinterNative {
+		return nativeFingerprint(ctx, audioPath)
+	}
+	return fpcalcFingerprint(ctx, audioPath)
+}
+
+func fpcalcFingerprint(ctx context.Context, audioPath string) ([]int32, error) {
+	fp, err := ffmpeg.Fpcalc(ctx, os.Getenv("FPCALC_PATH"), audioPath, maxFingerprintSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get fingerprints: %w", err)
+	}
+
+	fps := make([]int32, 0, len(fp))
+	for _, h := range fp {
+		fps = append(fps, int32(h))
+	}
+
+	return fps, nil
+}
+
+func nativeFingerprint(ctx context.Context, audioPath string) ([]int32, error) {
+	samples, format, err := ffmpeg.DecodePCM(ctx, audioPath, maxFingerprintSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode audio: %w", err)
+	}
+
+	fp, err := nativechromaprint.Fingerprint(samples, format.SampleRate, format.Channels, maxFingerprintSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get fingerprints: %w", err)
+	}
+
+	fps := make([]int32, 0, len(fp))
+	for _, h := range fp {
+		fps = append(fps, int32(h))
+	}
+
+	return fps, nil
+}
+
+func PerceptualHash(ctx context.Context, audioPath string) (uint64, error) {
 	tempDir, err := fsutils.GetTempDir()
 	if err != nil {
 		return 0, err
 	}
 	defer fsutils.CleanupTempDir(tempDir)
 
-	h, err := perceptualAudioHash(tempDir, audioPath)
+	h, err := perceptualAudioHash(ctx, tempDir, audioPath)
 	if err != nil {
 		return 0, fmt.Errorf("unable to calculate audio phash: %w", err)
 	}
@@ -28,33 +87,17 @@ func PerceptualHash(audioPath string) (uint64, error) {
 	return h, err
 }
 
-func perceptualAudioHash(tempDir, audioPath string) (uint64, error) {
+func perceptualAudioHash(ctx context.Context, tempDir, audioPath string) (uint64, error) {
 	tempAudioPath := path.Join(tempDir, uuid.NewString()+".mp3")
 
-	err := ffmpeg.PadAudioWithSilence(audioPath, tempAudioPath)
+	err := ffmpeg.PadAudioWithSilence(ctx, audioPath, tempAudioPath)
 	if err != nil {
 		return 0, fmt.Errorf("unable to pad audio: %w", err)
 	}
 
-	proc, err := chromaprint.NewBuilder().
-		WithPathToChromaprint(os.Getenv("FPCALC_PATH")).
-		WithOverlap(true).
-		WithMaxFingerPrintLength(60).
-		Build()
-	if err != nil {
-		return 0, fmt.Errorf("unable to create new builder: %w", err)
-	}
-
-	fp, err := proc.CreateFingerprints(tempAudioPath)
+	fps, err := rawFingerprint(ctx, tempAudioPath)
 	if err != nil {
-		return 0, fmt.Errorf("unable to get fingerprints: %w", err)
-	}
-
-	fps := []int32{}
-	for _, f := range fp {
-		for _, h := range f.Fingerprint {
-			fps = append(fps, int32(h))
-		}
+		return 0, err
 	}
 
 	img := fingerprint.ToImage(fps)
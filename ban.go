@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+const (
+	banListFileName = "banlist.txt"
+	// banListMaxSize keeps imports from downloading arbitrary files
+	banListMaxSize = 1024 * 1024
+)
+
+// formatBanList writes the ban list file, see README for the format
+func formatBanList(memes []BannedMeme) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("# memepolice banlist\n")
+
+	version := -1
+	for _, meme := range memes {
+		if meme.HashVersion != version {
+			version = meme.HashVersion
+			fmt.Fprintf(&buf, "hash_version %d\n", version)
+		}
+		fmt.Fprintf(&buf, "%s %s\n", meme.Kind, strings.Join(formatHashes(meme.Hash), ","))
+	}
+
+	return buf.Bytes()
+}
+
+func parseBanListHash(kind MatchKind, value string) ([]uint64, error) {
+	parts := strings.Split(value, ",")
+
+	switch {
+	case kind == MatchKindImage && len(parts) == 1:
+	case kind == MatchKindText && len(parts) == 1:
+	case kind == MatchKindVideo && (len(parts) == 1 || len(parts) == 2):
+	default:
+		return nil, fmt.Errorf("unexpected %d hashes for %s", len(parts), kind)
+	}
+
+	res := make([]uint64, 0, len(parts))
+	for _, part := range parts {
+		h, err := strconv.ParseUint(part, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q: %w", part, err)
+		}
+		res = append(res, h)
+	}
+
+	return res, nil
+}
+
+// parseBanList reads the ban list file, entries before the first hash_version line are of the current hashVersion
+func parseBanList(r io.Reader) ([]BannedMeme, error) {
+	var res []BannedMeme
+
+	version := hashVersion
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected 2 fields, got %d", line, len(fields))
+		}
+
+		if fields[0] == "hash_version" {
+			v, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid hash version: %w", line, err)
+			}
+			version = v
+			continue
+		}
+
+		kind := MatchKind(fields[0])
+		hash, err := parseBanListHash(kind, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		res = append(res, BannedMeme{
+			Kind:        kind,
+			Hash:        hash,
+			HashVersion: version,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read ban list: %w", err)
+	}
+
+	return res, nil
+}
+
+// findBannedMeme returns the banned meme within the chat distance of the hash, hashes of other versions never match
+func findBannedMeme(memes []BannedMeme, chatSettings *ChatSettings, kind MatchKind, hash []uint64) *BannedMeme {
+	threshold := matchKindThreshold(chatSettings, kind)
+	if threshold == nil {
+		return nil
+	}
+
+	for i, meme := range memes {
+		if meme.Kind != kind || meme.HashVersion != hashVersion {
+			continue
+		}
+		dist := fingerprintDistance(meme.Hash, hash)
+		if dist != nil && *dist <= *threshold {
+			return &memes[i]
+		}
+	}
+
+	return nil
+}
+
+// deleteBannedMeme deletes the message when it is a near match of a banned meme,
+// such messages are not checked for reposts
+func (r *UpdateHandler) deleteBannedMeme(ctx context.Context, storage Storage, message *tg.Message, chatSettings *ChatSettings, kind *MatchKind, hash []uint64) (bool, error) {
+	if kind == nil {
+		return false, nil
+	}
+
+	memes, err := storage.ListBannedMemes(ctx, message.Chat.ID)
+	if err != nil {
+		return false, fmt.Errorf("unable to list banned memes: %w", err)
+	}
+
+	banned := findBannedMeme(memes, chatSettings, *kind, hash)
+	if banned == nil {
+		return false, nil
+	}
+
+	slog.InfoContext(ctx, "deleting banned meme",
+		slog.Int64("chat_id", message.Chat.ID),
+		slog.Int("message_id", message.MessageID),
+		slog.Int64("banned_meme_id", banned.ID),
+	)
+
+	err = r.deleteMessage(ctx, message.Chat.ID, message.MessageID)
+	if err != nil {
+		return true, fmt.Errorf("unable to delete banned meme: %w", err)
+	}
+
+	if !chatSettings.BanWarning {
+		return true, nil
+	}
+
+	poster := message.From.FirstName
+	if message.From.UserName != "" {
+		poster = "@" + message.From.UserName
+	}
+
+	_, err = r.sendMessage(ctx, message.Chat.ID, fmt.Sprintf("%s, этот мем запрещен в чате, сообщение удалено", poster))
+	if err != nil {
+		return true, fmt.Errorf("unable to send banned meme warning: %w", err)
+	}
+
+	return true, nil
+}
+
+// handleBan bans the hashes of the replied meme and deletes it
+func (r *UpdateHandler) handleBan(ctx context.Context, storage Storage, message *tg.Message) error {
+	if message.ReplyToMessage == nil {
+		err := r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_reply", r.assets.GetAudioNoRererence())
+		if err != nil {
+			return fmt.Errorf("unable to send no_reply voice message %w", err)
+		}
+		return nil
+	}
+
+	isAdmin, err := r.checkAdmin(ctx, message)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	bannedMsg, err := storage.GetMessage(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get message: %w", err)
+	}
+
+	var kind *MatchKind
+	var hash []uint64
+	if err == nil {
+		kind, hash, err = r.getBanFingerprint(ctx, bannedMsg)
+		if err != nil {
+			return fmt.Errorf("unable to get banned meme fingerprint: %w", err)
+		}
+	}
+	if kind == nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "у этого сообщения нет хэшей, запретить не получится")
+		if err != nil {
+			return fmt.Errorf("unable to send no hashes reply: %w", err)
+		}
+		return nil
+	}
+
+	created, err := storage.CreateBannedMeme(ctx, BannedMeme{
+		ChatID:          message.Chat.ID,
+		Kind:            *kind,
+		Hash:            hash,
+		HashVersion:     hashVersion,
+		SourceMessageID: &bannedMsg.MessageID,
+		AuthorID:        message.From.ID,
+		CreatedAt:       time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save banned meme: %w", err)
+	}
+
+	err = r.deleteMessage(ctx, message.Chat.ID, bannedMsg.MessageID)
+	if err != nil {
+		slog.WarnContext(ctx, "unable to delete banned meme", slog.String("err", err.Error()))
+	}
+
+	replyText := "мем запрещен"
+	if !created {
+		replyText = "мем уже запрещен"
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, replyText)
+	if err != nil {
+		return fmt.Errorf("unable to send banned reply: %w", err)
+	}
+
+	return nil
+}
+
+// getBanFingerprint returns the stored hashes of the message, media hashes of older versions
+// are calculated again, as bans of other versions never match
+func (r *UpdateHandler) getBanFingerprint(ctx context.Context, bannedMsg *Message) (*MatchKind, []uint64, error) {
+	kind, hash := bannedMsg.fingerprint()
+	if kind == nil || *kind == MatchKindText || val(bannedMsg.HashVersion) == hashVersion {
+		return kind, hash, nil
+	}
+
+	mediaHash, err := r.getMessageMediaHash(ctx, &bannedMsg.Raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get message media hash: %w", err)
+	}
+
+	return mediaHash.matchKind(), mediaHash.fingerprint(), nil
+}
+
+// handleUnban removes a ban by its number from /banlist
+func (r *UpdateHandler) handleUnban(ctx context.Context, storage Storage, message *tg.Message) error {
+	isAdmin, err := r.checkAdmin(ctx, message)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	id, err := strconv.ParseInt(strings.Trim(message.CommandArguments(), " "), 10, 64)
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть номером из /banlist")
+		if err != nil {
+			return fmt.Errorf("unable to send int parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	deleted, err := storage.DeleteBannedMeme(ctx, message.Chat.ID, id)
+	if err != nil {
+		return fmt.Errorf("unable to delete banned meme: %w", err)
+	}
+
+	replyText := "мем больше не запрещен"
+	if !deleted {
+		replyText = "такого запрета нет"
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, replyText)
+	if err != nil {
+		return fmt.Errorf("unable to send unbanned reply: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleBanList(ctx context.Context, storage Storage, message *tg.Message) error {
+	memes, err := storage.ListBannedMemes(ctx, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to list banned memes: %w", err)
+	}
+
+	if len(memes) == 0 {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "запрещенных мемов нет")
+		if err != nil {
+			return fmt.Errorf("unable to send empty ban list reply: %w", err)
+		}
+		return nil
+	}
+
+	var text strings.Builder
+	text.WriteString("Запрещенные мемы:")
+	for _, meme := range memes {
+		fmt.Fprintf(&text, "\n%d. %s %s", meme.ID, formatMatchKind(meme.Kind), meme.CreatedAt.Format("02.01.2006"))
+		if meme.SourceMessageID == nil {
+			text.WriteString(", импорт")
+		}
+		if meme.HashVersion != hashVersion {
+			fmt.Fprintf(&text, ", устаревшая версия хэша %d", meme.HashVersion)
+		}
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, text.String())
+	if err != nil {
+		return fmt.Errorf("unable to send ban list reply: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleBanExport(ctx context.Context, storage Storage, message *tg.Message) error {
+	memes, err := storage.ListBannedMemes(ctx, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to list banned memes: %w", err)
+	}
+
+	_, err = r.sendDocumentReply(ctx, message.Chat.ID, message.MessageID, banListFileName, formatBanList(memes))
+	if err != nil {
+		return fmt.Errorf("unable to send ban list: %w", err)
+	}
+
+	return nil
+}
+
+// handleBanImport adds the hashes of the ban list file the command replies to
+func (r *UpdateHandler) handleBanImport(ctx context.Context, storage Storage, message *tg.Message) error {
+	if message.ReplyToMessage == nil || message.ReplyToMessage.Document == nil {
+		_, err := r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "надо реплай на файл со списком")
+		if err != nil {
+			return fmt.Errorf("unable to send no file reply: %w", err)
+		}
+		return nil
+	}
+
+	isAdmin, err := r.checkAdmin(ctx, message)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	document := message.ReplyToMessage.Document
+	if document.FileSize > banListMaxSize {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "файл слишком большой")
+		if err != nil {
+			return fmt.Errorf("unable to send too big file reply: %w", err)
+		}
+		return nil
+	}
+
+	file, err := r.getTelegramFile(ctx, document.FileID)
+	if err != nil {
+		return fmt.Errorf("unable to get ban list file: %w", err)
+	}
+	defer file.Close()
+
+	memes, err := parseBanList(io.LimitReader(file, banListMaxSize))
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, fmt.Sprintf("не получилось прочитать список: %s", err.Error()))
+		if err != nil {
+			return fmt.Errorf("unable to send parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	created := 0
+	for _, meme := range memes {
+		meme.ChatID = message.Chat.ID
+		meme.AuthorID = message.From.ID
+		meme.CreatedAt = time.Now().UTC()
+
+		ok, err := storage.CreateBannedMeme(ctx, meme)
+		if err != nil {
+			return fmt.Errorf("unable to save banned meme: %w", err)
+		}
+		if ok {
+			created++
+		}
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID,
+		fmt.Sprintf("добавлено запретов: %d, уже были: %d", created, len(memes)-created))
+	if err != nil {
+		return fmt.Errorf("unable to send imported reply: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleChatSettingsBanWarning(ctx context.Context, storage Storage, message *tg.Message) error {
+	enabled, err := parseBoolArgument(message.CommandArguments())
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть on или off")
+		if err != nil {
+			return fmt.Errorf("unable to send bool parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.BanWarning = enabled
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/NinaLeven/MemePolice/audiohash"
+	"github.com/NinaLeven/MemePolice/videohash"
+)
+
+// calibrationReportVersion changes whenever the report layout does,
+// reports of the same version produced by different hashers can be diffed directly
+const calibrationReportVersion = 1
+
+const (
+	labelDuplicate = "duplicate"
+	labelDistinct  = "distinct"
+)
+
+const maxHammingDistance = 64
+
+type calibrationPair struct {
+	A         string
+	B         string
+	Duplicate bool
+}
+
+type hasherInfo struct {
+	HashVersion         int    `json:"hash_version"`
+	Image               string `json:"image"`
+	VideoFrameSelection string `json:"video_frame_selection"`
+	AudioFingerprinter  string `json:"audio_fingerprinter"`
+}
+
+type curvePoint struct {
+	Threshold      int     `json:"threshold"`
+	TruePositives  int     `json:"true_positives"`
+	FalsePositives int     `json:"false_positives"`
+	FalseNegatives int     `json:"false_negatives"`
+	Precision      float64 `json:"precision"`
+	Recall         float64 `json:"recall"`
+	F1             float64 `json:"f1"`
+}
+
+type mediaCalibration struct {
+	Duplicates int `json:"duplicates"`
+	Distinct   int `json:"distinct"`
+	// RecommendedThreshold is the smallest threshold with the best recall while the precision is kept,
+	// or the best f1 threshold when no threshold keeps it
+	RecommendedThreshold *int         `json:"recommended_threshold"`
+	Curve                []curvePoint `json:"curve"`
+}
+
+type calibratedPair struct {
+	A        string `json:"a"`
+	B        string `json:"b"`
+	Label    string `json:"label"`
+	Kind     string `json:"kind,omitempty"`
+	Distance *int   `json:"distance,omitempty"`
+	Skipped  string `json:"skipped,omitempty"`
+}
+
+type calibrationReport struct {
+	ReportVersion int                          `json:"report_version"`
+	CreatedAt     time.Time                    `json:"created_at"`
+	Hasher        hasherInfo                   `json:"hasher"`
+	MinPrecision  float64                      `json:"min_precision"`
+	MinQuality    float64                      `json:"min_quality"`
+	MediaTypes    map[string]*mediaCalibration `json:"media_types"`
+	Pairs         []calibratedPair             `json:"pairs"`
+}
+
+func runCalibrateCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("calibrate", flag.ContinueOnError)
+	minPrecision := flags.Float64("min-precision", 0.99, "precision the recommended thresholds must keep")
+	minQuality := flags.Float64("min-quality", defaultChatSettings(0).MinImageQuality, "pairs with less detailed media are skipped like the bot does")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: memepolice calibrate [flags] <pairs.csv>")
+	}
+
+	pairs, err := readCalibrationPairs(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("unable to read pairs: %w", err)
+	}
+
+	report, err := calibrate(ctx, pairs, *minPrecision, *minQuality)
+	if err != nil {
+		return fmt.Errorf("unable to calibrate: %w", err)
+	}
+
+	return printJSON(report)
+}
+
+// readCalibrationPairs reads a,b,label rows, the header is optional,
+// relative paths are resolved against the csv dir
+func readCalibrationPairs(csvPath string) ([]calibrationPair, error) {
+	file, err := os.Open(csvPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open csv: %w", err)
+	}
+	defer file.Close()
+
+	baseDir := filepath.Dir(csvPath)
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+
+	var res []calibrationPair
+
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read csv: %w", err)
+		}
+
+		label := strings.ToLower(strings.TrimSpace(record[2]))
+		if line == 1 && label == "label" {
+			continue
+		}
+		if label != labelDuplicate && label != labelDistinct {
+			return nil, fmt.Errorf("line %d: label must be %s or %s, got %q", line, labelDuplicate, labelDistinct, record[2])
+		}
+
+		pair := calibrationPair{
+			A:         record[0],
+			B:         record[1],
+			Duplicate: label == labelDuplicate,
+		}
+		if !filepath.IsAbs(pair.A) {
+			pair.A = filepath.Join(baseDir, pair.A)
+		}
+		if !filepath.IsAbs(pair.B) {
+			pair.B = filepath.Join(baseDir, pair.B)
+		}
+
+		res = append(res, pair)
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no pairs")
+	}
+
+	return res, nil
+}
+
+func calibrate(ctx context.Context, pairs []calibrationPair, minPrecision, minQuality float64) (*calibrationReport, error) {
+	report := &calibrationReport{
+		ReportVersion: calibrationReportVersion,
+		CreatedAt:     time.Now().UTC(),
+		Hasher: hasherInfo{
+			HashVersion:         hashVersion,
+			Image:               "phash",
+			VideoFrameSelection: string(videohash.FrameSelection()),
+			AudioFingerprinter:  audiohash.Fingerprinter(),
+		},
+		MinPrecision: minPrecision,
+		MinQuality:   minQuality,
+		MediaTypes:   map[string]*mediaCalibration{},
+		Pairs:        make([]calibratedPair, 0, len(pairs)),
+	}
+
+	// the same file is often a part of several pairs
+	hashes := map[string]*fileHash{}
+	getHash := func(filePath string) (*fileHash, error) {
+		if h, ok := hashes[filePath]; ok {
+			return h, nil
+		}
+		h, err := hashFile(ctx, filePath)
+		if err != nil {
+			return nil, err
+		}
+		hashes[filePath] = h
+		return h, nil
+	}
+
+	distances := map[string][]calibratedPair{}
+
+	for _, pair := range pairs {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		res := calibratedPair{
+			A:     pair.A,
+			B:     pair.B,
+			Label: labelDistinct,
+		}
+		if pair.Duplicate {
+			res.Label = labelDuplicate
+		}
+
+		a, err := getHash(pair.A)
+		if err == nil {
+			var b *fileHash
+			b, err = getHash(pair.B)
+			if err == nil {
+				res.Kind = a.Kind
+				res.Distance, res.Skipped = pairDistance(a, b, minQuality)
+			}
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "unable to hash pair", slog.String("a", pair.A), slog.String("b", pair.B), slog.String("err", err.Error()))
+			res.Skipped = err.Error()
+		}
+
+		report.Pairs = append(report.Pairs, res)
+		if res.Distance != nil {
+			distances[res.Kind] = append(distances[res.Kind], res)
+		}
+	}
+
+	for kind, kindPairs := range distances {
+		report.MediaTypes[kind] = calibrateMediaType(kindPairs, minPrecision)
+	}
+
+	return report, nil
+}
+
+// pairDistance is the distance the bot compares with the chat threshold:
+// videos match only when both frames and audio are within it, so their distance is the larger one
+func pairDistance(a, b *fileHash, minQuality float64) (*int, string) {
+	if a.Kind != b.Kind {
+		return nil, fmt.Sprintf("%s is not comparable with %s", a.Kind, b.Kind)
+	}
+	if a.FrameSelection != b.FrameSelection {
+		return nil, fmt.Sprintf("frames selected by %s are not comparable with %s", a.FrameSelection, b.FrameSelection)
+	}
+	for _, h := range []*fileHash{a, b} {
+		if h.Quality != nil && *h.Quality < minQuality {
+			return nil, fmt.Sprintf("%s has too little detail: quality %.2f", h.Path, *h.Quality)
+		}
+	}
+
+	switch a.Kind {
+	case fileKindImage:
+		return ptr(bits.OnesCount64(a.image ^ b.image)), ""
+	case fileKindVideo:
+		return ptr(max(bits.OnesCount64(a.video^b.video), bits.OnesCount64(a.audio^b.audio))), ""
+	default:
+		return ptr(bits.OnesCount64(a.audio ^ b.audio)), ""
+	}
+}
+
+func calibrateMediaType(pairs []calibratedPair, minPrecision float64) *mediaCalibration {
+	res := &mediaCalibration{
+		Curve: make([]curvePoint, 0, maxHammingDistance+1),
+	}
+
+	for _, p := range pairs {
+		if p.Label == labelDuplicate {
+			res.Duplicates++
+		} else {
+			res.Distinct++
+		}
+	}
+
+	bestF1 := -1.0
+	var bestF1Threshold int
+	precisionKept := true
+	bestRecall := 0.0
+
+	for threshold := 0; threshold <= maxHammingDistance; threshold++ {
+		point := curvePoint{
+			Threshold: threshold,
+		}
+
+		for _, p := range pairs {
+			matched := *p.Distance <= threshold
+			switch {
+			case matched && p.Label == labelDuplicate:
+				point.TruePositives++
+			case matched:
+				point.FalsePositives++
+			case p.Label == labelDuplicate:
+				point.FalseNegatives++
+			}
+		}
+
+		// nothing matched means nothing was wrongly matched either
+		point.Precision = 1
+		if point.TruePositives+point.FalsePositives > 0 {
+			point.Precision = float64(point.TruePositives) / float64(point.TruePositives+point.FalsePositives)
+		}
+		if res.Duplicates > 0 {
+			point.Recall = float64(point.TruePositives) / float64(res.Duplicates)
+		}
+		if point.Precision+point.Recall > 0 {
+			point.F1 = 2 * point.Precision * point.Recall / (point.Precision + point.Recall)
+		}
+
+		// larger thresholds only add matches, once the precision drops the rest of the curve is not trusted
+		precisionKept = precisionKept && point.Precision >= minPrecision
+		if precisionKept && point.Recall > bestRecall {
+			bestRecall = point.Recall
+			res.RecommendedThreshold = ptr(threshold)
+		}
+		if point.F1 > bestF1 {
+			bestF1, bestF1Threshold = point.F1, threshold
+		}
+
+		res.Curve = append(res.Curve, point)
+	}
+
+	if res.RecommendedThreshold == nil && bestF1 > 0 {
+		res.RecommendedThreshold = ptr(bestF1Threshold)
+	}
+
+	return res
+}
@@ -0,0 +1,78 @@
+package chromaprint
+
+import (
+	"math"
+	"math/bits"
+)
+
+// fft computes power spectrum of hamming windowed frames of a fixed size.
+type fft struct {
+	size    int
+	window  []float32
+	cos     []float64
+	sin     []float64
+	reverse []int
+	re      []float64
+	im      []float64
+}
+
+func newFFT(size int) *fft {
+	f := &fft{
+		size:    size,
+		window:  make([]float32, size),
+		cos:     make([]float64, size/2),
+		sin:     make([]float64, size/2),
+		reverse: make([]int, size),
+		re:      make([]float64, size),
+		im:      make([]float64, size),
+	}
+
+	// chromaprint keeps the window in floats scaled to int16 range
+	scale := float64(float32(1.0 / math.MaxInt16))
+	step := 2 * math.Pi / float64(size-1)
+	for i := range f.window {
+		f.window[i] = float32(scale * (0.54 - 0.46*math.Cos(step*float64(i))))
+	}
+
+	for i := range f.cos {
+		f.cos[i] = math.Cos(2 * math.Pi * float64(i) / float64(size))
+		f.sin[i] = -math.Sin(2 * math.Pi * float64(i) / float64(size))
+	}
+
+	shift := bits.UintSize - bits.Len(uint(size-1))
+	for i := range f.reverse {
+		f.reverse[i] = int(bits.Reverse(uint(i)) >> shift)
+	}
+
+	return f
+}
+
+// compute writes power spectrum of the frame into out, out has size/2+1 bins.
+func (f *fft) compute(frame []int16, out []float64) {
+	for i, s := range frame {
+		j := f.reverse[i]
+		f.re[j] = float64(float32(s) * f.window[i])
+		f.im[j] = 0
+	}
+
+	for half := 1; half < f.size; half <<= 1 {
+		step := f.size / (half << 1)
+		for start := 0; start < f.size; start += half << 1 {
+			for k := 0; k < half; k++ {
+				wr, wi := f.cos[k*step], f.sin[k*step]
+				a, b := start+k, start+k+half
+
+				tr := f.re[b]*wr - f.im[b]*wi
+				ti := f.re[b]*wi + f.im[b]*wr
+
+				f.re[b], f.im[b] = f.re[a]-tr, f.im[a]-ti
+				f.re[a], f.im[a] = f.re[a]+tr, f.im[a]+ti
+			}
+		}
+	}
+
+	for i := 0; i <= f.size/2; i++ {
+		re, im := float32(f.re[i]), float32(f.im[i])
+		out[i] = float64(re*re + im*im)
+	}
+}
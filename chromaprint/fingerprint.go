@@ -0,0 +1,271 @@
+// Package chromaprint is a native implementation of the Chromaprint audio fingerprint (algorithm 2, the fpcalc default).
+// For the PCM in testdata it produces the same raw fingerprint as fpcalc 1.5.1, see TestFingerprintGolden.
+package chromaprint
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	sampleRate       = 11025
+	frameSize        = 4096
+	frameOverlap     = frameSize - frameSize/3
+	frameIncrement   = frameSize - frameOverlap
+	minFreq          = 28
+	maxFreq          = 3520
+	numBands         = 12
+	maxFilterWidth   = 16
+	maxBufferSize    = 1024 * 32
+	resampleLength   = 16
+	resamplePhase    = 8
+	resampleCutoff   = 0.8
+	normalizeMinNorm = 0.01
+)
+
+var chromaFilterCoefficients = []float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+// Fingerprinter consumes interleaved 16 bit PCM and calculates raw fingerprint.
+type Fingerprinter struct {
+	channels  int
+	resampler *resampler
+
+	buffer         []int16
+	resampleBuffer []int16
+
+	fft         *fft
+	frameBuffer []int16
+	spectrum    []float64
+
+	notes    []int
+	minIndex int
+	maxIndex int
+
+	chromaBuffer [][]float64
+	chromaOffset int
+	chromaSize   int
+
+	image       [][]float64
+	fingerprint []uint32
+}
+
+// NewFingerprinter creates a fingerprinter for the PCM of the given sample rate and channels count.
+func NewFingerprinter(inputSampleRate, channels int) (*Fingerprinter, error) {
+	if channels <= 0 {
+		return nil, fmt.Errorf("invalid channels count: %d", channels)
+	}
+	if inputSampleRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate: %d", inputSampleRate)
+	}
+
+	f := &Fingerprinter{
+		channels:       channels,
+		buffer:         make([]int16, 0, maxBufferSize),
+		resampleBuffer: make([]int16, maxBufferSize),
+		fft:            newFFT(frameSize),
+		spectrum:       make([]float64, frameSize/2+1),
+		chromaBuffer:   make([][]float64, 8),
+	}
+
+	if inputSampleRate != sampleRate {
+		f.resampler = newResampler(sampleRate, inputSampleRate, resampleLength, resamplePhase, resampleCutoff)
+	}
+
+	for i := range f.chromaBuffer {
+		f.chromaBuffer[i] = make([]float64, numBands)
+	}
+
+	f.prepareNotes()
+
+	return f, nil
+}
+
+func freqToIndex(freq float64) int {
+	return int(math.Round(frameSize * freq / sampleRate))
+}
+
+func (f *Fingerprinter) prepareNotes() {
+	f.minIndex = max(1, freqToIndex(minFreq))
+	f.maxIndex = min(frameSize/2, freqToIndex(maxFreq))
+	f.notes = make([]int, frameSize)
+
+	for i := f.minIndex; i < f.maxIndex; i++ {
+		freq := float64(i) * sampleRate / frameSize
+		octave := math.Log(freq/(440.0/16.0)) / math.Log(2.0)
+		note := numBands * (octave - math.Floor(octave))
+		f.notes[i] = int(note)
+	}
+}
+
+// Feed consumes interleaved samples.
+func (f *Fingerprinter) Feed(samples []int16) {
+	frames := len(samples) / f.channels
+
+	for frames > 0 {
+		n := min(frames, maxBufferSize-len(f.buffer))
+		f.load(samples[:n*f.channels])
+		samples = samples[n*f.channels:]
+		frames -= n
+
+		if len(f.buffer) == maxBufferSize {
+			f.resample()
+		}
+	}
+}
+
+// load downmixes samples to mono into the buffer
+func (f *Fingerprinter) load(samples []int16) {
+	switch f.channels {
+	case 1:
+		f.buffer = append(f.buffer, samples...)
+
+	case 2:
+		for i := 0; i+1 < len(samples); i += 2 {
+			f.buffer = append(f.buffer, int16((int(samples[i])+int(samples[i+1]))/2))
+		}
+
+	default:
+		for i := 0; i+f.channels <= len(samples); i += f.channels {
+			var sum int32
+			for c := 0; c < f.channels; c++ {
+				sum += int32(samples[i+c])
+			}
+			f.buffer = append(f.buffer, int16(sum/int32(f.channels)))
+		}
+	}
+}
+
+func (f *Fingerprinter) resample() {
+	if f.resampler == nil {
+		f.consumeSamples(f.buffer)
+		f.buffer = f.buffer[:0]
+		return
+	}
+
+	length, consumed := f.resampler.resample(f.resampleBuffer, f.buffer)
+	f.consumeSamples(f.resampleBuffer[:length])
+
+	remaining := max(len(f.buffer)-consumed, 0)
+	if remaining > 0 {
+		copy(f.buffer, f.buffer[consumed:])
+	}
+	f.buffer = f.buffer[:remaining]
+}
+
+func (f *Fingerprinter) consumeSamples(samples []int16) {
+	f.frameBuffer = append(f.frameBuffer, samples...)
+
+	offset := 0
+	for len(f.frameBuffer)-offset >= frameSize {
+		f.fft.compute(f.frameBuffer[offset:offset+frameSize], f.spectrum)
+		f.consumeSpectrum(f.spectrum)
+		offset += frameIncrement
+	}
+
+	f.frameBuffer = append(f.frameBuffer[:0], f.frameBuffer[offset:]...)
+}
+
+func (f *Fingerprinter) consumeSpectrum(spectrum []float64) {
+	features := f.chromaBuffer[f.chromaOffset]
+	clear(features)
+
+	for i := f.minIndex; i < f.maxIndex; i++ {
+		features[f.notes[i]] += spectrum[i]
+	}
+
+	f.chromaOffset = (f.chromaOffset + 1) % len(f.chromaBuffer)
+
+	filterSize := len(chromaFilterCoefficients)
+	if f.chromaSize < filterSize-1 {
+		f.chromaSize++
+		return
+	}
+
+	offset := (f.chromaOffset + len(f.chromaBuffer) - filterSize) % len(f.chromaBuffer)
+
+	row := make([]float64, numBands)
+	for i := range row {
+		for j := 0; j < filterSize; j++ {
+			row[i] += f.chromaBuffer[(offset+j)%len(f.chromaBuffer)][i] * chromaFilterCoefficients[j]
+		}
+	}
+
+	normalize(row)
+
+	f.addImageRow(row)
+}
+
+func normalize(row []float64) {
+	norm := 0.0
+	for _, v := range row {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+
+	if norm < normalizeMinNorm {
+		clear(row)
+		return
+	}
+
+	for i := range row {
+		row[i] /= norm
+	}
+}
+
+// addImageRow appends a row to the integral image and calculates next subfingerprint once there are enough rows
+func (f *Fingerprinter) addImageRow(row []float64) {
+	integral := make([]float64, numBands)
+
+	sum := 0.0
+	for i, v := range row {
+		sum += v
+		integral[i] = sum
+	}
+	if len(f.image) > 0 {
+		last := f.image[len(f.image)-1]
+		for i := range integral {
+			integral[i] += last[i]
+		}
+	}
+
+	f.image = append(f.image, integral)
+
+	if len(f.image) >= maxFilterWidth {
+		f.fingerprint = append(f.fingerprint, f.subfingerprint(len(f.image)-maxFilterWidth))
+	}
+}
+
+var grayCode = [4]uint32{0, 1, 3, 2}
+
+func (f *Fingerprinter) subfingerprint(offset int) uint32 {
+	var bits uint32
+	for _, c := range classifiers {
+		bits = (bits << 2) | grayCode[c.classify(f.image, offset)]
+	}
+	return bits
+}
+
+// Finish flushes buffered samples and returns the raw fingerprint.
+func (f *Fingerprinter) Finish() []uint32 {
+	if len(f.buffer) > 0 {
+		f.resample()
+	}
+
+	return f.fingerprint
+}
+
+// Fingerprint calculates raw fingerprint of at most maxDuration seconds of interleaved PCM, 0 means no limit.
+func Fingerprint(samples []int16, inputSampleRate, channels, maxDuration int) ([]uint32, error) {
+	f, err := NewFingerprinter(inputSampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxDuration > 0 {
+		samples = samples[:min(len(samples), maxDuration*inputSampleRate*channels)]
+	}
+
+	f.Feed(samples)
+
+	return f.Finish(), nil
+}
@@ -0,0 +1,89 @@
+package chromaprint
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The golden fingerprints are the raw output of fpcalc 1.5.1 for the same PCM:
+//
+//	fpcalc -format s16le -rate 11025 -channels 1 -length 60 -raw -plain mono_11025.s16le
+//	fpcalc -format s16le -rate 22050 -channels 2 -length 60 -raw -plain stereo_22050.s16le
+//
+// The PCM is a synthetic melody of chords with a little noise.
+func TestFingerprintGolden(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate int
+		channels   int
+	}{
+		{name: "mono_11025", sampleRate: 11025, channels: 1},
+		// the input is downmixed and resampled before fingerprinting
+		{name: "stereo_22050", sampleRate: 22050, channels: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := readPCM(t, path.Join("testdata", tt.name+".s16le"))
+			want := readGolden(t, path.Join("testdata", tt.name+".fpcalc"))
+
+			got, err := Fingerprint(samples, tt.sampleRate, tt.channels, 60)
+			if err != nil {
+				t.Fatalf("Fingerprint() error = %v", err)
+			}
+
+			if len(got) != len(want) {
+				t.Fatalf("Fingerprint() length = %d, want %d", len(got), len(want))
+			}
+
+			bitErrors := 0
+			for i := range got {
+				bitErrors += bits.OnesCount32(got[i] ^ want[i])
+			}
+			if bitErrors != 0 {
+				t.Errorf("Fingerprint() differs from fpcalc in %d of %d bits", bitErrors, 32*len(want))
+			}
+		})
+	}
+}
+
+func readPCM(t *testing.T, name string) []int16 {
+	t.Helper()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unable to read pcm: %v", err)
+	}
+
+	samples := make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+
+	return samples
+}
+
+func readGolden(t *testing.T, name string) []uint32 {
+	t.Helper()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unable to read golden fingerprint: %v", err)
+	}
+
+	var res []uint32
+	for _, field := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		v, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			t.Fatalf("unable to parse golden fingerprint: %v", err)
+		}
+		res = append(res, uint32(v))
+	}
+
+	return res
+}
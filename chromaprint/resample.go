@@ -0,0 +1,159 @@
+package chromaprint
+
+import "math"
+
+// resampler is a port of av_resample (libavcodec/resample2.c) that chromaprint uses internally,
+// it has to be replicated bit for bit to produce the same fingerprints as fpcalc.
+type resampler struct {
+	filterBank   []int16
+	filterLength int
+	dstIncr      int
+	index        int
+	frac         int
+	srcIncr      int
+	phaseShift   uint
+	phaseMask    int
+}
+
+const (
+	resampleFilterShift = 15
+	resampleWindowType  = 9
+)
+
+func bessel(x float64) float64 {
+	v := 1.0
+	lastv := 0.0
+	t := 1.0
+
+	x = x * x / 4
+	for i := 1; v != lastv; i++ {
+		lastv = v
+		t *= x / float64(i*i)
+		v += t
+	}
+
+	return v
+}
+
+func buildFilter(filter []int16, factor float64, tapCount, phaseCount, scale, windowType int) {
+	tab := make([]float64, tapCount)
+	center := (tapCount - 1) / 2
+
+	// if upsampling, only need to interpolate, no filter
+	if factor > 1.0 {
+		factor = 1.0
+	}
+
+	for ph := 0; ph < phaseCount; ph++ {
+		norm := 0.0
+		for i := 0; i < tapCount; i++ {
+			x := math.Pi * (float64(i-center) - float64(ph)/float64(phaseCount)) * factor
+			y := 1.0
+			if x != 0 {
+				y = math.Sin(x) / x
+			}
+
+			w := 2.0 * x / (factor * float64(tapCount) * math.Pi)
+			y *= bessel(float64(windowType) * math.Sqrt(math.Max(1-w*w, 0)))
+
+			tab[i] = y
+			norm += y
+		}
+
+		for i := 0; i < tapCount; i++ {
+			v := lrintf(float32(tab[i] * float64(scale) / norm))
+			filter[ph*tapCount+i] = int16(min(max(v, math.MinInt16), math.MaxInt16))
+		}
+	}
+}
+
+// lrintf rounds half to even like the default fenv rounding mode
+func lrintf(v float32) int {
+	return int(math.RoundToEven(float64(v)))
+}
+
+func newResampler(outRate, inRate, filterSize int, phaseShift uint, cutoff float64) *resampler {
+	factor := math.Min(float64(outRate)*cutoff/float64(inRate), 1.0)
+	phaseCount := 1 << phaseShift
+
+	r := &resampler{
+		phaseShift: phaseShift,
+		phaseMask:  phaseCount - 1,
+	}
+
+	r.filterLength = max(int(math.Ceil(float64(filterSize)/factor)), 1)
+	r.filterBank = make([]int16, r.filterLength*(phaseCount+1))
+
+	buildFilter(r.filterBank, factor, r.filterLength, phaseCount, 1<<resampleFilterShift, resampleWindowType)
+
+	copy(r.filterBank[r.filterLength*phaseCount+1:], r.filterBank[:r.filterLength-1])
+	r.filterBank[r.filterLength*phaseCount] = r.filterBank[r.filterLength-1]
+
+	r.srcIncr = outRate
+	r.dstIncr = inRate * phaseCount
+	r.index = -phaseCount * ((r.filterLength - 1) / 2)
+
+	return r
+}
+
+// resample converts src into dst, it returns the number of written samples and consumed source samples.
+func (r *resampler) resample(dst, src []int16) (int, int) {
+	index := r.index
+	frac := r.frac
+	dstIncrFrac := r.dstIncr % r.srcIncr
+	dstIncr := r.dstIncr / r.srcIncr
+	srcSize := len(src)
+
+	dstIndex := 0
+	for ; dstIndex < len(dst); dstIndex++ {
+		filter := r.filterBank[r.filterLength*(index&r.phaseMask):]
+		sampleIndex := index >> r.phaseShift
+
+		if sampleIndex >= 0 && sampleIndex+r.filterLength > srcSize {
+			break
+		}
+
+		var val int32
+		if sampleIndex < 0 {
+			for i := 0; i < r.filterLength; i++ {
+				val += int32(src[abs(sampleIndex+i)%srcSize]) * int32(filter[i])
+			}
+		} else {
+			for i := 0; i < r.filterLength; i++ {
+				val += int32(src[sampleIndex+i]) * int32(filter[i])
+			}
+		}
+
+		val = (val + (1 << (resampleFilterShift - 1))) >> resampleFilterShift
+		if uint32(val+32768) > 65535 {
+			dst[dstIndex] = int16((val >> 31) ^ 32767)
+		} else {
+			dst[dstIndex] = int16(val)
+		}
+
+		frac += dstIncrFrac
+		index += dstIncr
+		if frac >= r.srcIncr {
+			frac -= r.srcIncr
+			index++
+		}
+	}
+
+	consumed := max(index, 0) >> r.phaseShift
+	if index >= 0 {
+		index &= r.phaseMask
+	}
+
+	r.frac = frac
+	r.index = index
+	r.dstIncr = dstIncrFrac + r.srcIncr*dstIncr
+
+	return dstIndex, consumed
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/NinaLeven/MemePolice/audiohash"
+	"github.com/NinaLeven/MemePolice/ffmpeg"
+	"github.com/NinaLeven/MemePolice/imageutils"
+	"github.com/NinaLeven/MemePolice/videohash"
+)
+
+const (
+	fileKindImage = "image"
+	fileKindVideo = "video"
+	fileKindAudio = "audio"
+)
+
+// fileHash is what the bot would store for a file, hashes are hex so they survive json number precision
+type fileHash struct {
+	Path           string   `json:"path"`
+	Kind           string   `json:"kind"`
+	ImageHash      string   `json:"image_hash,omitempty"`
+	VideoHash      string   `json:"video_hash,omitempty"`
+	AudioHash      string   `json:"audio_hash,omitempty"`
+	FrameSelection string   `json:"frame_selection,omitempty"`
+	Quality        *float64 `json:"quality,omitempty"`
+	Frames         []string `json:"frames,omitempty"`
+	HashVersion    int      `json:"hash_version"`
+
+	image  uint64
+	video  uint64
+	audio  uint64
+	frames []uint64
+}
+
+type thresholds struct {
+	ImageHammingDistance int
+	VideoHammingDistance int
+	MinImageQuality      float64
+}
+
+func thresholdsFlags(flags *flag.FlagSet) *thresholds {
+	settings := defaultChatSettings(0)
+
+	res := &thresholds{}
+	flags.IntVar(&res.ImageHammingDistance, "img-hdist", settings.ImageHammingDistance, "hamming distance for similar images")
+	flags.IntVar(&res.VideoHammingDistance, "vid-hdist", settings.VideoHammingDistance, "hamming distance for similar videos and audio")
+	flags.Float64Var(&res.MinImageQuality, "min-quality", settings.MinImageQuality, "minimal quality of media to be compared")
+
+	return res
+}
+
+// runCommand runs offline subcommands that need neither telegram nor postgres
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "hash":
+		return runHashCommand(ctx, args[1:])
+	case "compare":
+		return runCompareCommand(ctx, args[1:])
+	case "scan":
+		return runScanCommand(ctx, args[1:])
+	case "calibrate":
+		return runCalibrateCommand(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q, expected hash, compare, scan or calibrate", args[0])
+	}
+}
+
+func runHashCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("hash", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: memepolice hash <file>...")
+	}
+
+	res := make([]*fileHash, 0, flags.NArg())
+	for _, filePath := range flags.Args() {
+		h, err := hashFile(ctx, filePath)
+		if err != nil {
+			return fmt.Errorf("unable to hash %s: %w", filePath, err)
+		}
+		res = append(res, h)
+	}
+
+	if len(res) == 1 {
+		return printJSON(res[0])
+	}
+	return printJSON(res)
+}
+
+type componentDistance struct {
+	Distance  int `json:"distance"`
+	Threshold int `json:"threshold"`
+}
+
+type comparison struct {
+	A       *fileHash          `json:"a"`
+	B       *fileHash          `json:"b"`
+	Image   *componentDistance `json:"image,omitempty"`
+	Video   *componentDistance `json:"video,omitempty"`
+	Audio   *componentDistance `json:"audio,omitempty"`
+	Verdict string             `json:"verdict"`
+	Reason  string             `json:"reason,omitempty"`
+}
+
+const (
+	verdictRepost       = "repost"
+	verdictDifferent    = "different"
+	verdictIncomparable = "incomparable"
+)
+
+func runCompareCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ContinueOnError)
+	th := thresholdsFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: memepolice compare [flags] <a> <b>")
+	}
+
+	a, err := hashFile(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("unable to hash %s: %w", flags.Arg(0), err)
+	}
+
+	b, err := hashFile(ctx, flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("unable to hash %s: %w", flags.Arg(1), err)
+	}
+
+	return printJSON(compareHashes(a, b, *th))
+}
+
+// compareHashes applies the same rules the bot uses when it looks for a repost
+func compareHashes(a, b *fileHash, th thresholds) *comparison {
+	res := &comparison{
+		A:       a,
+		B:       b,
+		Verdict: verdictDifferent,
+	}
+
+	switch {
+	// a screenshot matches any frame of the video it was taken from
+	case a.Kind == fileKindImage && b.Kind == fileKindVideo || a.Kind == fileKindVideo && b.Kind == fileKindImage:
+		res.Image = framesDistance(a, b, th.ImageHammingDistance)
+		if res.Image.Distance <= res.Image.Threshold {
+			res.Verdict = verdictRepost
+		}
+
+	case a.Kind != b.Kind:
+		res.Verdict = verdictIncomparable
+		res.Reason = fmt.Sprintf("%s is not comparable with %s", a.Kind, b.Kind)
+		return res
+
+	case a.FrameSelection != b.FrameSelection:
+		res.Verdict = verdictIncomparable
+		res.Reason = fmt.Sprintf("frames selected by %s are not comparable with %s", a.FrameSelection, b.FrameSelection)
+		return res
+
+	case a.Kind == fileKindImage:
+		res.Image = distance(a.image, b.image, th.ImageHammingDistance)
+		if res.Image.Distance <= res.Image.Threshold {
+			res.Verdict = verdictRepost
+		}
+
+	case a.Kind == fileKindVideo:
+		res.Video = distance(a.video, b.video, th.VideoHammingDistance)
+		res.Audio = distance(a.audio, b.audio, th.VideoHammingDistance)
+		if res.Video.Distance <= res.Video.Threshold && res.Audio.Distance <= res.Audio.Threshold {
+			res.Verdict = verdictRepost
+		}
+
+	case a.Kind == fileKindAudio:
+		res.Audio = distance(a.audio, b.audio, th.VideoHammingDistance)
+		if res.Audio.Distance <= res.Audio.Threshold {
+			res.Verdict = verdictRepost
+		}
+	}
+
+	for _, h := range []*fileHash{a, b} {
+		if h.Quality != nil && *h.Quality < th.MinImageQuality {
+			res.Verdict = verdictIncomparable
+			res.Reason = fmt.Sprintf("%s has too little detail: quality %.2f, minimum %.2f", h.Path, *h.Quality, th.MinImageQuality)
+		}
+	}
+
+	return res
+}
+
+// framesDistance is the distance between the image and the closest video frame
+func framesDistance(a, b *fileHash, threshold int) *componentDistance {
+	img, video := a, b
+	if img.Kind != fileKindImage {
+		img, video = b, a
+	}
+
+	res := &componentDistance{
+		Distance:  maxHammingDistance,
+		Threshold: threshold,
+	}
+	for _, frame := range video.frames {
+		res.Distance = min(res.Distance, bits.OnesCount64(img.image^frame))
+	}
+
+	return res
+}
+
+func distance(a, b uint64, threshold int) *componentDistance {
+	return &componentDistance{
+		Distance:  bits.OnesCount64(a ^ b),
+		Threshold: threshold,
+	}
+}
+
+type scanResult struct {
+	Files    int        `json:"files"`
+	Skipped  []string   `json:"skipped,omitempty"`
+	Clusters [][]string `json:"clusters"`
+}
+
+func runScanCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	th := thresholdsFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: memepolice scan [flags] <dir>")
+	}
+
+	res, err := scanDir(ctx, flags.Arg(0), *th)
+	if err != nil {
+		return fmt.Errorf("unable to scan %s: %w", flags.Arg(0), err)
+	}
+
+	return printJSON(res)
+}
+
+// scanDir hashes every file in the dir recursively and groups the reposts of each other,
+// clusters are transitive: a~b and b~c put a, b and c together
+func scanDir(ctx context.Context, dirPath string, th thresholds) (*scanResult, error) {
+	res := &scanResult{
+		Clusters: [][]string{},
+	}
+
+	var hashes []*fileHash
+
+	err := filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		res.Files++
+
+		h, err := hashFile(ctx, filePath)
+		if err != nil {
+			slog.WarnContext(ctx, "unable to hash file", slog.String("path", filePath), slog.String("err", err.Error()))
+			res.Skipped = append(res.Skipped, filePath)
+			return nil
+		}
+
+		hashes = append(hashes, h)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk dir: %w", err)
+	}
+
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if compareHashes(hashes[i], hashes[j], th).Verdict == verdictRepost {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	clusters := map[int][]string{}
+	for i, h := range hashes {
+		root := find(i)
+		clusters[root] = append(clusters[root], h.Path)
+	}
+
+	for _, paths := range clusters {
+		if len(paths) > 1 {
+			sort.Strings(paths)
+			res.Clusters = append(res.Clusters, paths)
+		}
+	}
+
+	sort.Slice(res.Clusters, func(i, j int) bool {
+		return res.Clusters[i][0] < res.Clusters[j][0]
+	})
+
+	return res, nil
+}
+
+// hashFile hashes decodable images as photos, everything else is probed with ffmpeg
+// and hashed as a video when it has a video stream or as audio otherwise
+func hashFile(ctx context.Context, filePath string) (*fileHash, error) {
+	img, err := imageutils.DecodeFile(filePath)
+	if err == nil {
+		h, err := getImageHash(img)
+		if err != nil {
+			return nil, err
+		}
+
+		return &fileHash{
+			Path:        filePath,
+			Kind:        fileKindImage,
+			ImageHash:   formatHash(*h.ImageHash),
+			Quality:     h.Quality,
+			HashVersion: hashVersion,
+			image:       *h.ImageHash,
+		}, nil
+	}
+	if !errors.Is(err, &imageutils.ErrUnsupportedFormat{}) {
+		return nil, fmt.Errorf("unable to decode image: %w", err)
+	}
+
+	probe, err := ffmpeg.Probe(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to probe media: %w", err)
+	}
+
+	switch {
+	case probe.VideoStream() != nil:
+		h, err := videohash.PerceptualHash(ctx, filePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to calculate video hash: %w", err)
+		}
+
+		return &fileHash{
+			Path:           filePath,
+			Kind:           fileKindVideo,
+			VideoHash:      formatHash(h.Video),
+			AudioHash:      formatHash(h.Audio),
+			FrameSelection: string(h.FrameSelection),
+			Quality:        ptr(h.Quality),
+			Frames:         formatHashes(h.Frames),
+			HashVersion:    hashVersion,
+			video:          h.Video,
+			audio:          h.Audio,
+			frames:         h.Frames,
+		}, nil
+
+	case probe.AudioStream() != nil:
+		h, err := audiohash.PerceptualHash(ctx, filePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to calculate audio hash: %w", err)
+		}
+
+		return &fileHash{
+			Path:        filePath,
+			Kind:        fileKindAudio,
+			AudioHash:   formatHash(h),
+			HashVersion: hashVersion,
+			audio:       h,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("no image, video or audio in %s", probe.FormatName)
+	}
+}
+
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func formatHashes(hs []uint64) []string {
+	res := make([]string, 0, len(hs))
+	for _, h := range hs {
+		res = append(res, formatHash(h))
+	}
+	return res
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	err := enc.Encode(v)
+	if err != nil {
+		return fmt.Errorf("unable to encode result: %w", err)
+	}
+
+	return nil
+}
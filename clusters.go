@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+const (
+	topMemeClustersLimit = 10
+	memeHistoryLimit     = 20
+)
+
+// joinMemeCluster puts the message into the cluster of its matches. When the matches belong to different clusters
+// the message bridges them and they are merged into the oldest one, so every near duplicate of a meme
+// is compared with the same first message. Returns the first message of the resulting cluster.
+func joinMemeCluster(ctx context.Context, storage Storage, chatID int64, messageID int, matches []*Message) (*Message, error) {
+	clusterIDs := make([]int, 0, len(matches)+1)
+
+	// the message is already a cluster of its own when it is checked again, e.g. after an edit
+	ownClusterID, err := storage.GetMemeClusterID(ctx, chatID, messageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return nil, fmt.Errorf("unable to get message meme cluster: %w", err)
+	}
+	if err == nil {
+		clusterIDs = append(clusterIDs, ownClusterID)
+	}
+
+	for _, match := range matches {
+		clusterID, err := storage.GetMemeClusterID(ctx, chatID, match.MessageID)
+		if err != nil && !errors.Is(err, &ErrNotFound{}) {
+			return nil, fmt.Errorf("unable to get match meme cluster: %w", err)
+		}
+		if err != nil {
+			err = storage.CreateMemeCluster(ctx, chatID, match.MessageID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create match meme cluster: %w", err)
+			}
+			clusterID = match.MessageID
+		}
+		clusterIDs = append(clusterIDs, clusterID)
+	}
+
+	if len(clusterIDs) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	// message ids grow, so the smallest cluster id is the oldest cluster
+	target := clusterIDs[0]
+	for _, clusterID := range clusterIDs {
+		target = min(target, clusterID)
+	}
+
+	merged := map[int]bool{target: true}
+	for _, clusterID := range clusterIDs {
+		if merged[clusterID] {
+			continue
+		}
+		merged[clusterID] = true
+
+		err = storage.MergeMemeClusters(ctx, chatID, clusterID, target)
+		if err != nil {
+			return nil, fmt.Errorf("unable to merge meme clusters: %w", err)
+		}
+	}
+
+	err = storage.UpsertMemeClusterMember(ctx, MemeClusterMember{
+		ChatID:    chatID,
+		MessageID: messageID,
+		ClusterID: target,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to add message to meme cluster: %w", err)
+	}
+
+	origin, err := storage.GetMemeClusterOrigin(ctx, chatID, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get meme cluster origin: %w", err)
+	}
+
+	return origin, nil
+}
+
+// leaveMemeCluster makes the message a cluster of its own, e.g. when its repost verdict was amended
+func leaveMemeCluster(ctx context.Context, storage Storage, chatID int64, messageID int) error {
+	err := storage.UpsertMemeClusterMember(ctx, MemeClusterMember{
+		ChatID:    chatID,
+		MessageID: messageID,
+		ClusterID: messageID,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to move message to its own meme cluster: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleHistory(ctx context.Context, storage Storage, message *tg.Message) error {
+	if message.ReplyToMessage == nil {
+		err := r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_reply", r.assets.GetAudioNoRererence())
+		if err != nil {
+			return fmt.Errorf("unable to send no_reply voice message %w", err)
+		}
+		return nil
+	}
+
+	clusterID, err := storage.GetMemeClusterID(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get meme cluster: %w", err)
+	}
+
+	var messages []Message
+	if err == nil {
+		messages, err = storage.ListMemeClusterMessages(ctx, message.Chat.ID, clusterID)
+		if err != nil {
+			return fmt.Errorf("unable to list meme cluster messages: %w", err)
+		}
+	}
+
+	if len(messages) < 2 {
+		err = r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_repeat", r.assets.GetAudioNoRepeat())
+		if err != nil {
+			return fmt.Errorf("unable to send no_repeat voice message %w", err)
+		}
+		return nil
+	}
+
+	messageIDs := make([]int, 0, len(messages))
+	for _, msg := range messages {
+		messageIDs = append(messageIDs, msg.MessageID)
+	}
+
+	manualMatches, err := storage.ListManualMatches(ctx, message.Chat.ID, messageIDs)
+	if err != nil {
+		return fmt.Errorf("unable to list manual matches: %w", err)
+	}
+
+	manualOriginals := map[int]int{}
+	for _, m := range manualMatches {
+		manualOriginals[m.MessageID] = m.OriginalMessageID
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "История мема, всего %d:", len(messages))
+	for i, msg := range messages {
+		if i == memeHistoryLimit {
+			fmt.Fprintf(&text, "\n... и еще %d", len(messages)-memeHistoryLimit)
+			break
+		}
+		fmt.Fprintf(&text, "\n%d. %s - %s",
+			i+1,
+			messageLink(message.Chat, msg.MessageID),
+			msg.CreatedAt.Format("02.01.2006"),
+		)
+		if msg.DeletedAt != nil {
+			text.WriteString(", удалено")
+		}
+		if originalID, ok := manualOriginals[msg.MessageID]; ok {
+			fmt.Fprintf(&text, ", вручную к %s", messageLink(message.Chat, originalID))
+		}
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, text.String())
+	if err != nil {
+		return fmt.Errorf("unable to send history reply: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleStats(ctx context.Context, storage Storage, message *tg.Message) error {
+	clusters, err := storage.ListTopMemeClusters(ctx, message.Chat.ID, topMemeClustersLimit)
+	if err != nil {
+		return fmt.Errorf("unable to list top meme clusters: %w", err)
+	}
+
+	if len(clusters) == 0 {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "баянов пока нет")
+		if err != nil {
+			return fmt.Errorf("unable to send no stats reply: %w", err)
+		}
+		return nil
+	}
+
+	var text strings.Builder
+	text.WriteString("Самые баянистые мемы:")
+	for i, c := range clusters {
+		fmt.Fprintf(&text, "\n%d. %s - повторов: %d, последний %s",
+			i+1,
+			messageLink(message.Chat, c.ClusterID),
+			c.Size-1,
+			c.LastSeenAt.Format("02.01.2006"),
+		)
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, text.String())
+	if err != nil {
+		return fmt.Errorf("unable to send stats reply: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/NinaLeven/MemePolice/ffmpeg"
+	"github.com/NinaLeven/MemePolice/fsutils"
+	"github.com/NinaLeven/MemePolice/imageutils"
+	tg "github.com/OvyFlash/telegram-bot-api"
+	_ "golang.org/x/image/bmp"
+)
+
+// ffmpegImageMimeTypes are image formats without a go decoder, they are converted with ffmpeg first
+var ffmpegImageMimeTypes = map[string]string{
+	"image/heic": ".heic",
+	"image/heif": ".heif",
+}
+
+// handleNewDocument hashes images and videos sent as files,
+// their hashes are matched against regular photos and videos.
+func (r *UpdateHandler) handleNewDocument(ctx context.Context, storage Storage, message *tg.Message) (*mediaHash, error) {
+	// animations and stickers come with a document too
+	if message.Document == nil || message.Animation != nil || message.Sticker != nil {
+		return nil, nil
+	}
+
+	document := message.Document
+
+	switch {
+	case strings.HasPrefix(document.MimeType, "image/"):
+		if document.FileSize > 1024*1024*20 {
+			slog.WarnContext(ctx, "image document too big", slog.Int64("size", document.FileSize))
+			return nil, nil
+		}
+
+		img, err := r.getTelegramDocumentImage(ctx, document)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get telegram document image: %w", err)
+		}
+
+		hash, err := getImageHash(img)
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.checkImageRepost(ctx, storage, message, hash)
+		if err != nil {
+			return hash, fmt.Errorf("unable to check image repost: %w", err)
+		}
+
+		return hash, nil
+
+	case strings.HasPrefix(document.MimeType, "video/"):
+		if document.FileSize > 1024*1024*120 {
+			slog.WarnContext(ctx, "video document too big", slog.Int64("size", document.FileSize))
+			return nil, nil
+		}
+
+		hash, err := r.getTelegramVideoHash(ctx, document.FileID, document.MimeType)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get telegram video hash: %w", err)
+		}
+
+		err = r.checkVideoRepost(ctx, storage, message, hash)
+		if err != nil {
+			return hash, fmt.Errorf("unable to check video repost: %w", err)
+		}
+
+		return hash, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+func (r *UpdateHandler) getTelegramDocumentImage(ctx context.Context, document *tg.Document) (image.Image, error) {
+	ext, ok := ffmpegImageMimeTypes[document.MimeType]
+	if !ok {
+		return r.getTelegramImage(ctx, document.FileID)
+	}
+
+	tempDir, err := fsutils.GetTempDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get temp dir: %w", err)
+	}
+	defer fsutils.CleanupTempDir(tempDir)
+
+	tempImagePath := path.Join(tempDir, "image"+ext)
+	tempConvertedPath := path.Join(tempDir, "image.png")
+
+	err = r.getTelegramVideo(ctx, document.FileID, tempImagePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get telegram file: %w", err)
+	}
+
+	err = ffmpeg.ConvertImage(ctx, tempImagePath, tempConvertedPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert image: %w", err)
+	}
+
+	file, err := os.Open(tempConvertedPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open converted image: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := imageutils.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode image: %w", err)
+	}
+
+	return img, nil
+}
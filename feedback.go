@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"slices"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+// amendsToTighten is how many amended matches at the largest distances make the threshold worth tightening
+const amendsToTighten = 3
+
+// reencodeDistance is how far hashes of the same media sent again may be apart
+const reencodeDistance = 2
+
+// fingerprint is the kind and the hashes a match is made by, the kind is nil for media without hashes
+func fingerprint(imageHash, videoHash, audioHash, textHash *uint64) (*MatchKind, []uint64) {
+	switch {
+	case imageHash != nil:
+		return ptr(MatchKindImage), []uint64{*imageHash}
+	case videoHash != nil && audioHash != nil:
+		return ptr(MatchKindVideo), []uint64{*videoHash, *audioHash}
+	case videoHash != nil:
+		return ptr(MatchKindVideo), []uint64{*videoHash}
+	case textHash != nil:
+		return ptr(MatchKindText), []uint64{*textHash}
+	default:
+		return nil, nil
+	}
+}
+
+func (h *mediaHash) fingerprint() []uint64 {
+	if h == nil {
+		return nil
+	}
+	_, res := fingerprint(h.ImageHash, h.VideoVideoHash, h.VideoAudioHash, nil)
+	return res
+}
+
+func (h *mediaHash) matchKind() *MatchKind {
+	if h == nil {
+		return nil
+	}
+	res, _ := fingerprint(h.ImageHash, h.VideoVideoHash, h.VideoAudioHash, nil)
+	return res
+}
+
+func (m *Message) fingerprint() (*MatchKind, []uint64) {
+	return fingerprint(m.ImageHash, m.VideoVideoHash, m.VideoAudioHash, m.TextHash)
+}
+
+// fingerprintDistance is the largest distance of the hashes, as videos match only when all of them are close
+func fingerprintDistance(a, b []uint64) *int {
+	if len(a) == 0 || len(a) != len(b) {
+		return nil
+	}
+
+	dist := 0
+	for i := range a {
+		dist = max(dist, bits.OnesCount64(a[i]^b[i]))
+	}
+
+	return &dist
+}
+
+// isAmendedMatch tells that the message is a copy of a message already matched with the original and amended.
+// The feedback is recorded for the first message of the cluster, so the match is checked against it too.
+func isAmendedMatch(ctx context.Context, storage Storage, origMessage *Message, kind *MatchKind, hash []uint64) (bool, error) {
+	if kind == nil || len(hash) == 0 {
+		return false, nil
+	}
+
+	clusterOrigMsg, err := storage.GetMemeClusterOrigin(ctx, origMessage.ChatID, origMessage.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return false, fmt.Errorf("unable to get meme cluster origin: %w", err)
+	}
+	if err == nil {
+		origMessage = clusterOrigMsg
+	}
+
+	feedback, err := storage.ListOriginalMatchFeedback(ctx, origMessage.ChatID, origMessage.MessageID)
+	if err != nil {
+		return false, fmt.Errorf("unable to list original match feedback: %w", err)
+	}
+
+	origKind, origHash := origMessage.fingerprint()
+	if origKind == nil || *origKind != *kind {
+		origHash = nil
+	}
+
+	amended := findAmendedMatch(*kind, hash, origHash, feedback)
+	if amended != nil {
+		slog.InfoContext(ctx, "amended match is skipped",
+			slog.Int64("chat_id", origMessage.ChatID),
+			slog.Int("original_message_id", origMessage.MessageID),
+			slog.Int("amended_message_id", amended.MessageID),
+		)
+	}
+
+	return amended != nil, nil
+}
+
+// findAmendedMatch returns the amended match the hash is strictly closer to than to the original, so that copies
+// of the original itself are still matched. When the original has no comparable hash, only re-encoded copies
+// of the amended message within reencodeDistance are skipped.
+func findAmendedMatch(kind MatchKind, hash, origHash []uint64, feedback []MatchFeedback) *MatchFeedback {
+	origDist := fingerprintDistance(hash, origHash)
+
+	for i, f := range feedback {
+		if f.Kind == nil || *f.Kind != kind {
+			continue
+		}
+
+		dist := fingerprintDistance(hash, f.Hash)
+		switch {
+		case dist == nil:
+		case origDist != nil && *dist < *origDist:
+			return &feedback[i]
+		case origDist == nil && *dist <= reencodeDistance:
+			return &feedback[i]
+		}
+	}
+
+	return nil
+}
+
+// saveMatchFeedback records the match of the amended message with the first message of its cluster
+func saveMatchFeedback(ctx context.Context, storage Storage, message *tg.Message, amendedMsg *Message) error {
+	origMsg, err := storage.GetMemeClusterOrigin(ctx, amendedMsg.ChatID, amendedMsg.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get meme cluster origin: %w", err)
+	}
+	if err != nil || origMsg.MessageID == amendedMsg.MessageID {
+		return nil
+	}
+
+	kind, hash := amendedMsg.fingerprint()
+	origKind, origHash := origMsg.fingerprint()
+
+	var distance *int
+	if kind != nil && origKind != nil && *kind == *origKind {
+		distance = fingerprintDistance(hash, origHash)
+	}
+
+	err = storage.UpsertMatchFeedback(ctx, MatchFeedback{
+		ChatID:            amendedMsg.ChatID,
+		MessageID:         amendedMsg.MessageID,
+		OriginalMessageID: origMsg.MessageID,
+		Kind:              kind,
+		Hash:              hash,
+		OriginalHash:      origHash,
+		Distance:          distance,
+		AuthorID:          message.From.ID,
+		CreatedAt:         time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save match feedback: %w", err)
+	}
+
+	return nil
+}
+
+func matchKindThreshold(settings *ChatSettings, kind MatchKind) *int {
+	switch kind {
+	case MatchKindImage:
+		return &settings.ImageHammingDistance
+	case MatchKindVideo:
+		return &settings.VideoHammingDistance
+	case MatchKindText:
+		return &settings.TextHammingDistance
+	default:
+		return nil
+	}
+}
+
+func formatMatchKind(kind MatchKind) string {
+	switch kind {
+	case MatchKindImage:
+		return "изображения"
+	case MatchKindVideo:
+		return "видео"
+	case MatchKindText:
+		return "тексты"
+	default:
+		return string(kind)
+	}
+}
+
+// suggestThreshold walks down from the current threshold and stops at the distance where amends pile up,
+// the suggested threshold leaves that distance and the ones above it out. Amends above the current threshold
+// are already out and are not counted.
+func suggestThreshold(threshold int, distances map[int]int) *int {
+	amends := 0
+	for dist := threshold; dist > 0; dist-- {
+		amends += distances[dist]
+		if amends >= amendsToTighten {
+			return ptr(dist - 1)
+		}
+	}
+
+	return nil
+}
+
+// handleAmends reports amended matches, "/amends apply" applies the suggested thresholds
+func (r *UpdateHandler) handleAmends(ctx context.Context, storage Storage, message *tg.Message) error {
+	feedback, err := storage.ListMatchFeedback(ctx, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to list match feedback: %w", err)
+	}
+
+	if len(feedback) == 0 {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "исправлений пока нет")
+		if err != nil {
+			return fmt.Errorf("unable to send no amends reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	distances := map[MatchKind]map[int]int{}
+	other := 0
+	for _, f := range feedback {
+		if f.Kind == nil || f.Distance == nil {
+			other++
+			continue
+		}
+		if distances[*f.Kind] == nil {
+			distances[*f.Kind] = map[int]int{}
+		}
+		distances[*f.Kind][*f.Distance]++
+	}
+
+	apply := strings.Trim(message.CommandArguments(), " ") == "apply"
+	applied := false
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "Исправленных ложных повторов: %d", len(feedback))
+
+	for _, kind := range []MatchKind{MatchKindImage, MatchKindVideo, MatchKindText} {
+		kindDistances, ok := distances[kind]
+		if !ok {
+			continue
+		}
+
+		dists := make([]int, 0, len(kindDistances))
+		total := 0
+		for dist, count := range kindDistances {
+			dists = append(dists, dist)
+			total += count
+		}
+		slices.Sort(dists)
+
+		parts := make([]string, 0, len(dists))
+		for _, dist := range dists {
+			parts = append(parts, fmt.Sprintf("%d×%d", dist, kindDistances[dist]))
+		}
+
+		threshold := matchKindThreshold(chatSettings, kind)
+		fmt.Fprintf(&text, "\n* %s: %d, расстояние×количество: %s, порог %d", formatMatchKind(kind), total, strings.Join(parts, ", "), *threshold)
+
+		suggested := suggestThreshold(*threshold, kindDistances)
+		if suggested == nil {
+			continue
+		}
+		if apply {
+			*threshold = *suggested
+			applied = true
+			fmt.Fprintf(&text, ", новый порог %d", *suggested)
+		} else {
+			fmt.Fprintf(&text, ", советую порог %d", *suggested)
+		}
+	}
+
+	if other != 0 {
+		fmt.Fprintf(&text, "\n* без расстояния: %d", other)
+	}
+
+	if applied {
+		err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+		if err != nil {
+			return fmt.Errorf("unable to update chat settings: %w", err)
+		}
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, text.String())
+	if err != nil {
+		return fmt.Errorf("unable to send amends reply: %w", err)
+	}
+
+	return nil
+}
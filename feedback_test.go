@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestFindAmendedMatch(t *testing.T) {
+	const (
+		original = uint64(0)
+		// amended was matched with the original at distance 3
+		amended = uint64(0b111)
+	)
+
+	feedback := []MatchFeedback{{
+		MessageID: 2,
+		Kind:      ptr(MatchKindImage),
+		Hash:      []uint64{amended},
+	}}
+
+	tests := []struct {
+		name     string
+		kind     MatchKind
+		hash     []uint64
+		origHash []uint64
+		want     bool
+	}{
+		{"exact repost of the original", MatchKindImage, []uint64{original}, []uint64{original}, false},
+		{"copy of the original", MatchKindImage, []uint64{0b1}, []uint64{original}, false},
+		{"as close to both", MatchKindImage, []uint64{0b11000}, []uint64{original}, false},
+		{"exact repost of the amended", MatchKindImage, []uint64{amended}, []uint64{original}, true},
+		{"copy of the amended", MatchKindImage, []uint64{0b1111}, []uint64{original}, true},
+		{"other kind", MatchKindVideo, []uint64{amended}, []uint64{original}, false},
+		{"incomparable original, re-encoded amended", MatchKindImage, []uint64{0b11111}, nil, true},
+		{"incomparable original, far from amended", MatchKindImage, []uint64{0b111111111}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findAmendedMatch(tt.kind, tt.hash, tt.origHash, feedback) != nil
+			if got != tt.want {
+				t.Errorf("findAmendedMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+type fpcalcResult struct {
+	Duration    float64  `json:"duration"`
+	Fingerprint []uint32 `json:"fingerprint"`
+}
+
+// Fpcalc calculates the raw chromaprint of the first maxSeconds of the audio with fpcalc,
+// fpcalcPath may be empty to find fpcalc in PATH. It runs with the same timeout as ffmpeg.
+func Fpcalc(ctx context.Context, fpcalcPath, audioPath string, maxSeconds int) ([]uint32, error) {
+	if fpcalcPath == "" {
+		fpcalcPath = "fpcalc"
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd, cmdCtx, cancel := command(ctx, fpcalcPath, "-json", "-raw", "-overlap", "-length", strconv.Itoa(maxSeconds), audioPath)
+	defer cancel()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmdErr(cmdCtx, cmd.Run())
+	if err != nil {
+		return nil, fmt.Errorf("unable to run fpcalc: %w: %s", err, truncateOutput(stderr.String()))
+	}
+
+	var res fpcalcResult
+	err = json.Unmarshal(stdout.Bytes(), &res)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse fpcalc output: %w", err)
+	}
+
+	return res.Fingerprint, nil
+}
@@ -0,0 +1,76 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"time"
+)
+
+// Limits protect the update loop from huge or malicious files
+type Limits struct {
+	// Timeout is the wall clock limit of a single ffmpeg or ffprobe run
+	Timeout time.Duration
+	// MaxDuration is the longest media accepted for decoding
+	MaxDuration time.Duration
+	// MaxWidth and MaxHeight are the largest frame accepted for decoding
+	MaxWidth  int
+	MaxHeight int
+}
+
+var DefaultLimits = Limits{
+	Timeout:     2 * time.Minute,
+	MaxDuration: 10 * time.Minute,
+	MaxWidth:    4096,
+	MaxHeight:   4096,
+}
+
+var limits = DefaultLimits
+
+// SetLimits is not safe to call concurrently with other functions of the package, call it on startup
+func SetLimits(l Limits) {
+	limits = l
+}
+
+type ErrLimitExceeded struct {
+	Reason string
+}
+
+func (e *ErrLimitExceeded) Error() string {
+	return fmt.Sprintf("limit exceeded: %s", e.Reason)
+}
+
+func (e *ErrLimitExceeded) Is(target error) bool {
+	_, ok := target.(*ErrLimitExceeded)
+	return ok
+}
+
+// checkLimits rejects media before it is decoded
+func checkLimits(probe *ProbeResult) error {
+	if limits.MaxDuration > 0 && probe.Duration > limits.MaxDuration.Seconds() {
+		return &ErrLimitExceeded{
+			Reason: fmt.Sprintf("duration %.1fs is longer than %s", probe.Duration, limits.MaxDuration),
+		}
+	}
+
+	for _, s := range probe.Streams {
+		if s.CodecType != "video" {
+			continue
+		}
+		if limits.MaxWidth > 0 && s.Width > limits.MaxWidth || limits.MaxHeight > 0 && s.Height > limits.MaxHeight {
+			return &ErrLimitExceeded{
+				Reason: fmt.Sprintf("resolution %dx%d is larger than %dx%d", s.Width, s.Height, limits.MaxWidth, limits.MaxHeight),
+			}
+		}
+	}
+
+	return nil
+}
+
+// maxOutputInError is how much of ffmpeg output is kept in errors, the tail is the most useful part
+const maxOutputInError = 2048
+
+func truncateOutput(out string) string {
+	if len(out) <= maxOutputInError {
+		return out
+	}
+	return "..." + out[len(out)-maxOutputInError:]
+}
@@ -0,0 +1,208 @@
+package ffmpeg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type Stream struct {
+	Index     int
+	CodecType string
+	CodecName string
+
+	// video only
+	Width  int
+	Height int
+	// Rotation is clockwise rotation to apply for display: 0, 90, 180 or 270
+	Rotation   int
+	FrameRate  float64
+	FrameCount int
+
+	// audio only
+	SampleRate int
+	Channels   int
+
+	Duration float64
+}
+
+// DisplaySize is the frame size after rotation
+func (s *Stream) DisplaySize() (int, int) {
+	if s.Rotation == 90 || s.Rotation == 270 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+type ProbeResult struct {
+	FormatName string
+	Duration   float64
+	Streams    []Stream
+}
+
+// VideoStream returns the first video stream or nil for audio only files
+func (p *ProbeResult) VideoStream() *Stream {
+	return p.stream("video")
+}
+
+// AudioStream returns the first audio stream or nil for silent files
+func (p *ProbeResult) AudioStream() *Stream {
+	return p.stream("audio")
+}
+
+func (p *ProbeResult) stream(codecType string) *Stream {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == codecType {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+type probeSideData struct {
+	Rotation *float64 `json:"rotation"`
+}
+
+type probeStream struct {
+	Index        int               `json:"index"`
+	CodecType    string            `json:"codec_type"`
+	CodecName    string            `json:"codec_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	RFrameRate   string            `json:"r_frame_rate"`
+	AvgFrameRate string            `json:"avg_frame_rate"`
+	NbFrames     string            `json:"nb_frames"`
+	Duration     string            `json:"duration"`
+	SampleRate   string            `json:"sample_rate"`
+	Channels     int               `json:"channels"`
+	Tags         map[string]string `json:"tags"`
+	SideDataList []probeSideData   `json:"side_data_list"`
+}
+
+type probeFormat struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+}
+
+type probeInfo struct {
+	Streams []probeStream `json:"streams"`
+	Format  probeFormat   `json:"format"`
+}
+
+// Probe reads container and streams info with ffprobe
+func Probe(ctx context.Context, mediaPath string) (*ProbeResult, error) {
+	stdout, err := runCmd(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", mediaPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get media info: %w: %s", err, truncateOutput(stdout))
+	}
+
+	var inf probeInfo
+	err = json.Unmarshal([]byte(stdout), &inf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal media info: %w", err)
+	}
+
+	res := &ProbeResult{
+		FormatName: inf.Format.FormatName,
+		Duration:   parseFloat(inf.Format.Duration),
+		Streams:    make([]Stream, 0, len(inf.Streams)),
+	}
+
+	for _, s := range inf.Streams {
+		stream := Stream{
+			Index:     s.Index,
+			CodecType: s.CodecType,
+			CodecName: s.CodecName,
+			Duration:  parseFloat(s.Duration),
+		}
+		if stream.Duration == 0 {
+			stream.Duration = res.Duration
+		}
+
+		switch s.CodecType {
+		case "video":
+			stream.Width, stream.Height = s.Width, s.Height
+			stream.Rotation = streamRotation(s)
+			stream.FrameRate, stream.FrameCount = streamFrames(s, res.Duration)
+
+		case "audio":
+			stream.SampleRate, _ = strconv.Atoi(s.SampleRate)
+			stream.Channels = s.Channels
+		}
+
+		res.Streams = append(res.Streams, stream)
+	}
+
+	return res, nil
+}
+
+func parseFloat(v string) float64 {
+	res, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || math.IsNaN(res) || math.IsInf(res, 0) {
+		return 0
+	}
+	return res
+}
+
+// parseRate parses ffprobe rationals like 30000/1001, "0/0" is 0
+func parseRate(v string) float64 {
+	matches := frameRateRegex.FindStringSubmatch(v)
+	if len(matches) != 3 {
+		return 0
+	}
+
+	num, _ := strconv.Atoi(matches[1])
+	den, _ := strconv.Atoi(matches[2])
+	if den == 0 {
+		return 0
+	}
+
+	return float64(num) / float64(den)
+}
+
+// streamRotation converts the display matrix side data (counter clockwise)
+// or the legacy rotate tag (clockwise) to clockwise degrees
+func streamRotation(s probeStream) int {
+	rotation := 0
+
+	if tag, ok := s.Tags["rotate"]; ok {
+		rotation, _ = strconv.Atoi(tag)
+	}
+
+	for _, sd := range s.SideDataList {
+		if sd.Rotation != nil {
+			rotation = -int(math.Round(*sd.Rotation))
+		}
+	}
+
+	rotation = (rotation%360 + 360) % 360
+
+	// only right angles can be normalized
+	return rotation / 90 * 90
+}
+
+// streamFrames estimates frame rate and count. Constant frame rate streams use r_frame_rate and duration,
+// variable frame rate streams prefer the muxer frame count and the average rate
+func streamFrames(s probeStream, duration float64) (float64, int) {
+	rRate := parseRate(s.RFrameRate)
+	avgRate := parseRate(s.AvgFrameRate)
+	nbFrames, _ := strconv.Atoi(s.NbFrames)
+
+	isVFR := rRate > 0 && avgRate > 0 && math.Abs(rRate-avgRate) > 0.01
+
+	switch {
+	case rRate > 0 && !isVFR:
+		return rRate, int(math.Ceil(rRate * duration))
+	case nbFrames > 0 && duration > 0:
+		return float64(nbFrames) / duration, nbFrames
+	case nbFrames > 0:
+		return max(avgRate, rRate), nbFrames
+	case avgRate > 0:
+		return avgRate, int(math.Ceil(avgRate * duration))
+	default:
+		return rRate, int(math.Ceil(rRate * duration))
+	}
+}
@@ -1,8 +1,14 @@
 package ffmpeg
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"image"
+	"io"
 	"math"
 	"os/exec"
 	"path"
@@ -10,92 +16,198 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NinaLeven/MemePolice/fsutils"
 )
 
-func runCmd(cmdName string, args ...string) (string, error) {
-	cmd := exec.Command(cmdName, args...)
-	out, err := cmd.CombinedOutput()
-	return string(out), err
+// command starts a process bound to ctx and the configured timeout, cancel releases the timeout once the process is waited for
+func command(ctx context.Context, cmdName string, args ...string) (*exec.Cmd, context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if limits.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	cmd := exec.CommandContext(ctx, cmdName, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = time.Second
+
+	return cmd, ctx, cancel
 }
 
-func getTotalFrameCount(videoPath string) (int, error) {
-	stdout, err := runCmd("ffprobe", "-v", "quiet", "-print_format", "json", "-show_entries", "format=duration", "-show_entries", "stream=codec_type,r_frame_rate", videoPath)
-	if err != nil {
-		return 0, fmt.Errorf("unable to get video info: %w: %s", err, stdout)
+// cmdErr reports the timeout or cancellation instead of the bare "signal: killed"
+func cmdErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
 	}
+	return err
+}
 
-	type stream struct {
-		CodecType string `json:"codec_type"`
-		FrameRate string `json:"r_frame_rate"`
-	}
+func runCmd(ctx context.Context, cmdName string, args ...string) (string, error) {
+	cmd, ctx, cancel := command(ctx, cmdName, args...)
+	defer cancel()
+
+	out, err := cmd.CombinedOutput()
+	return string(out), cmdErr(ctx, err)
+}
+
+var frameRateRegex = regexp.MustCompile(`^(\d+)/(\d+)$`)
+
+type ErrNoFrames struct{}
+
+func (e *ErrNoFrames) Error() string {
+	return "no frames selected"
+}
+
+func (e *ErrNoFrames) Is(target error) bool {
+	_, ok := target.(*ErrNoFrames)
+	return ok
+}
+
+// FrameSelection is the way frames are sampled from a video.
+// Hashes of frames selected differently are not comparable.
+type FrameSelection string
+
+const (
+	// FrameSelectionNth selects every n-th frame, n is based on the frame rate and duration
+	FrameSelectionNth FrameSelection = "nth"
+	// FrameSelectionScene selects frames with scene changes
+	FrameSelectionScene FrameSelection = "scene"
+	// FrameSelectionFPS selects frames evenly spread over the duration
+	FrameSelectionFPS FrameSelection = "fps"
+)
+
+const sceneChangeThreshold = "0.3"
+
+func frameSelectionFilter(stream *Stream, selection FrameSelection, expectedFramesCount int) (string, error) {
+	switch selection {
+	case FrameSelectionNth:
+		framesInterval := max(1, stream.FrameCount/expectedFramesCount)
+
+		return "select='not(mod(n," + strconv.Itoa(framesInterval) + "))'", nil
+
+	case FrameSelectionScene:
+		return "select='gt(scene," + sceneChangeThreshold + ")'", nil
 
-	type format struct {
-		Duration string `json:"duration"`
+	case FrameSelectionFPS:
+		if stream.Duration <= 0 {
+			return "", fmt.Errorf("invalid duration: %f", stream.Duration)
+		}
+
+		return "fps=" + strconv.FormatFloat(float64(expectedFramesCount)/stream.Duration, 'f', 6, 64), nil
+
+	default:
+		return "", fmt.Errorf("unknown frame selection: %s", selection)
 	}
+}
 
-	type info struct {
-		Streams []stream `json:"streams"`
-		Format  format   `json:"format"`
+func rotationFilters(rotation int) []string {
+	switch rotation {
+	case 90:
+		return []string{"transpose=clock"}
+	case 180:
+		return []string{"hflip", "vflip"}
+	case 270:
+		return []string{"transpose=cclock"}
+	default:
+		return nil
 	}
+}
+
+var cropRegex = regexp.MustCompile(`crop=(\d+):(\d+):(\d+):(\d+)`)
 
-	var inf info
-	err = json.Unmarshal([]byte(stdout), &inf)
+// bars thinner than this fraction of the frame are noise of dark scenes rather than letterboxing
+const minCropFraction = 0.05
+
+// black bars are detected on the beginning of the video only, decoding all of it is as slow as extracting frames twice
+const (
+	cropDetectSeconds = "5"
+	cropDetectFrames  = "150"
+)
+
+// detectCrop finds black bars around the rotated frames and returns the crop filter, or an empty string if there are none
+func detectCrop(ctx context.Context, videoPath string, rotation []string, width, height int) (string, int, int, error) {
+	filters := append(slices.Clone(rotation), "cropdetect=limit=24:round=2:reset=0")
+
+	stdout, err := runCmd(ctx, "ffmpeg", "-noautorotate", "-i", videoPath, "-map", "0:v:0", "-t", cropDetectSeconds, "-frames:v", cropDetectFrames, "-vf", strings.Join(filters, ","), "-f", "null", "-")
 	if err != nil {
-		return 0, fmt.Errorf("unable to unmarshal video info: %w", err)
+		return "", 0, 0, fmt.Errorf("unable to run ffmpeg: %w: %s", err, truncateOutput(stdout))
 	}
 
-	var videoStream *stream
-	for _, s := range inf.Streams {
-		if s.CodecType == "video" {
-			videoStream = &s
-			break
-		}
+	matches := cropRegex.FindAllStringSubmatch(stdout, -1)
+	if len(matches) == 0 {
+		return "", width, height, nil
 	}
-	if videoStream == nil {
-		return 0, fmt.Errorf("unable to find video stream: %w", err)
+
+	last := matches[len(matches)-1]
+	w, _ := strconv.Atoi(last[1])
+	h, _ := strconv.Atoi(last[2])
+	x, _ := strconv.Atoi(last[3])
+	y, _ := strconv.Atoi(last[4])
+
+	if w <= 0 || h <= 0 || x+w > width || y+h > height {
+		return "", width, height, nil
 	}
+	if float64(width-w) < float64(width)*minCropFraction && float64(height-h) < float64(height)*minCropFraction {
+		return "", width, height, nil
+	}
+
+	return fmt.Sprintf("crop=%d:%d:%d:%d", w, h, x, y), w, h, nil
+}
 
-	matches := frameRateRegex.FindStringSubmatch(videoStream.FrameRate)
-	if len(matches) != 3 {
-		return 0, fmt.Errorf("frame rate unrecognized: %v", matches)
+// framesFilter builds the filter graph that rotates frames upright, removes black bars and selects frames.
+// It returns the graph and the resulting frame size.
+func framesFilter(ctx context.Context, videoPath string, selection FrameSelection, expectedFramesCount int) (string, int, int, error) {
+	probe, err := Probe(ctx, videoPath)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("unable to probe video: %w", err)
 	}
 
-	fps, err := strconv.Atoi(matches[1])
+	err = checkLimits(probe)
 	if err != nil {
-		return 0, fmt.Errorf("unable to parse frame count: %w", err)
+		return "", 0, 0, err
+	}
+
+	stream := probe.VideoStream()
+	if stream == nil {
+		return "", 0, 0, fmt.Errorf("unable to find video stream")
 	}
 
-	frameSecondsCount, err := strconv.Atoi(matches[2])
+	width, height := stream.DisplaySize()
+	if width <= 0 || height <= 0 {
+		return "", 0, 0, fmt.Errorf("invalid frame size: %dx%d", width, height)
+	}
+
+	filters := rotationFilters(stream.Rotation)
+
+	crop, width, height, err := detectCrop(ctx, videoPath, filters, width, height)
 	if err != nil {
-		return 0, fmt.Errorf("unable to parse frame seconds count: %w", err)
+		return "", 0, 0, fmt.Errorf("unable to detect crop: %w", err)
 	}
-	if frameSecondsCount == 0 {
-		return 0, fmt.Errorf("0 seconds")
+	if crop != "" {
+		filters = append(filters, crop)
 	}
 
-	secondsCount, err := strconv.ParseFloat(inf.Format.Duration, 64)
+	selectionFilter, err := frameSelectionFilter(stream, selection, expectedFramesCount)
 	if err != nil {
-		return 0, fmt.Errorf("unable to parse seconds count: %w", err)
+		return "", 0, 0, err
 	}
+	filters = append(filters, selectionFilter)
 
-	return int(math.Ceil(float64(fps) / float64(frameSecondsCount) * secondsCount)), nil
+	return strings.Join(filters, ","), width, height, nil
 }
 
-var frameRateRegex = regexp.MustCompile(`^(\d+)/(\d+)$`)
-
-func ExtractFrames(videoPath, framesDir string, expectedFramesCount int) ([]string, error) {
-	frameCount, err := getTotalFrameCount(videoPath)
+func ExtractFrames(ctx context.Context, videoPath, framesDir string, selection FrameSelection, expectedFramesCount int) ([]string, error) {
+	filter, _, _, err := framesFilter(ctx, videoPath, selection, expectedFramesCount)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get frame count: %w", err)
+		return nil, err
 	}
 
-	framesInterval := max(1, frameCount/expectedFramesCount)
-
-	stdout, err := runCmd("ffmpeg", "-i", videoPath, "-vf", "select='not(mod(n,"+strconv.Itoa(framesInterval)+"))'", "-vsync", "vfr", path.Join(framesDir, "%03d.png"))
+	stdout, err := runCmd(ctx, "ffmpeg", "-noautorotate", "-i", videoPath, "-vf", filter, "-vsync", "vfr", path.Join(framesDir, "%03d.png"))
 	if err != nil {
-		return nil, fmt.Errorf("unable to run ffmpeg: %w: %s", err, stdout)
+		return nil, fmt.Errorf("unable to run ffmpeg: %w: %s", err, truncateOutput(stdout))
 	}
 
 	frames, err := fsutils.LS(framesDir)
@@ -108,12 +220,108 @@ func ExtractFrames(videoPath, framesDir string, expectedFramesCount int) ([]stri
 	frames = frames[:min(len(frames), expectedFramesCount)]
 
 	if len(frames) == 0 {
-		return nil, fmt.Errorf("unable to extract frames: empty")
+		return nil, &ErrNoFrames{}
 	}
 
 	return frames, nil
 }
 
+// ExtractFramesRGB selects the same frames as ExtractFrames, but streams them
+// from ffmpeg stdout as raw rgb24 instead of writing png files
+func ExtractFramesRGB(ctx context.Context, videoPath string, selection FrameSelection, expectedFramesCount int) ([]*image.RGBA, error) {
+	filter, width, height, err := framesFilter(ctx, videoPath, selection, expectedFramesCount)
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+
+	cmd, cmdCtx, cancel := command(ctx, "ffmpeg", "-v", "error", "-noautorotate", "-i", videoPath,
+		"-vf", filter, "-vsync", "vfr",
+		"-frames:v", strconv.Itoa(expectedFramesCount),
+		"-f", "rawvideo", "-pix_fmt", "rgb24", "-")
+	defer cancel()
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ffmpeg stdout: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start ffmpeg: %w", err)
+	}
+
+	frames, readErr := readRGBFrames(bufio.NewReaderSize(stdout, width*3), width, height, expectedFramesCount)
+	if readErr != nil {
+		// unblock ffmpeg if it is still writing
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+
+	err = cmdErr(cmdCtx, cmd.Wait())
+	if err != nil {
+		return nil, fmt.Errorf("unable to run ffmpeg: %w: %s", err, truncateOutput(stderr.String()))
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read frames: %w", readErr)
+	}
+
+	if len(frames) == 0 {
+		return nil, &ErrNoFrames{}
+	}
+
+	return frames, nil
+}
+
+func readRGBFrames(r io.Reader, width, height, maxFrames int) ([]*image.RGBA, error) {
+	buf := make([]byte, width*height*3)
+
+	frames := []*image.RGBA{}
+	for len(frames) < maxFrames {
+		_, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for i, j := 0, 0; i < len(buf); i, j = i+3, j+4 {
+			img.Pix[j] = buf[i]
+			img.Pix[j+1] = buf[i+1]
+			img.Pix[j+2] = buf[i+2]
+			img.Pix[j+3] = 0xff
+		}
+
+		frames = append(frames, img)
+	}
+
+	return frames, nil
+}
+
+// ConvertImage converts a single image between formats, the output format is chosen by outputPath extension.
+// It is used for formats the go image decoders don't support, e.g. heic.
+func ConvertImage(ctx context.Context, inputPath, outputPath string) error {
+	probe, err := Probe(ctx, inputPath)
+	if err != nil {
+		return fmt.Errorf("unable to probe image: %w", err)
+	}
+
+	err = checkLimits(probe)
+	if err != nil {
+		return err
+	}
+
+	stdout, err := runCmd(ctx, "ffmpeg", "-i", inputPath, "-frames:v", "1", outputPath)
+	if err != nil {
+		return fmt.Errorf("unable to run ffmpeg: %w: %s", err, truncateOutput(stdout))
+	}
+
+	return nil
+}
+
 type ErrNoAudio struct {
 	Err error
 }
@@ -130,38 +338,48 @@ func (e *ErrNoAudio) Is(target error) bool {
 	return ok
 }
 
-func ExtractAudio(videoPath, audioPath string) error {
-	stdout, err := runCmd("ffmpeg", "-i", videoPath, "-q:a", "0", "-map", "a?" /*"-vn", "-acodec", "mp3",*/, audioPath)
+func ExtractAudio(ctx context.Context, videoPath, audioPath string) error {
+	probe, err := Probe(ctx, videoPath)
+	if err != nil {
+		return fmt.Errorf("unable to probe video: %w", err)
+	}
+
+	err = checkLimits(probe)
+	if err != nil {
+		return err
+	}
+
+	stdout, err := runCmd(ctx, "ffmpeg", "-i", videoPath, "-q:a", "0", "-map", "a?" /*"-vn", "-acodec", "mp3",*/, audioPath)
 	if err != nil {
 		if strings.Contains(stdout, "does not contain any stream") {
 			return &ErrNoAudio{
 				Err: err,
 			}
 		}
-		return fmt.Errorf("unable to run ffmpeg: %w: %s", err, stdout)
+		return fmt.Errorf("unable to run ffmpeg: %w: %s", err, truncateOutput(stdout))
 	}
 
 	return nil
 }
 
-func getAudioLen(audioPath string) (int, error) {
-	stdout, err := runCmd("ffprobe", "-i", audioPath, "-show_entries", "format=duration", "-v", "quiet", "-of", "csv=p=0")
+func getAudioLen(ctx context.Context, audioPath string) (int, error) {
+	probe, err := Probe(ctx, audioPath)
 	if err != nil {
-		return 0, fmt.Errorf("unable to get video info: %w: %s", err, stdout)
+		return 0, err
 	}
 
-	secondsCount, err := strconv.ParseFloat(strings.TrimSpace(stdout), 64)
+	err = checkLimits(probe)
 	if err != nil {
-		return 0, fmt.Errorf("unable to parse seconds count: %w", err)
+		return 0, err
 	}
 
-	return int(math.Ceil(secondsCount)), nil
+	return int(math.Ceil(probe.Duration)), nil
 }
 
 const maxPddingSeconds = 3
 
-func PadAudioWithSilence(inputAudioPath, outputAudioPath string) error {
-	audioLen, err := getAudioLen(inputAudioPath)
+func PadAudioWithSilence(ctx context.Context, inputAudioPath, outputAudioPath string) error {
+	audioLen, err := getAudioLen(ctx, inputAudioPath)
 	if err != nil {
 		return fmt.Errorf("unable to get audio length: %w", err)
 	}
@@ -170,10 +388,59 @@ func PadAudioWithSilence(inputAudioPath, outputAudioPath string) error {
 		audioLen = maxPddingSeconds
 	}
 
-	stdout, err := runCmd("ffmpeg", "-i", inputAudioPath, "-af", "apad,atrim=end="+strconv.Itoa(audioLen) /*"-t", strconv.Itoa(maxPddingSeconds-audioLen),*/, outputAudioPath)
+	stdout, err := runCmd(ctx, "ffmpeg", "-i", inputAudioPath, "-af", "apad,atrim=end="+strconv.Itoa(audioLen) /*"-t", strconv.Itoa(maxPddingSeconds-audioLen),*/, outputAudioPath)
 	if err != nil {
-		return fmt.Errorf("unable to run ffmpeg: %w: %s", err, stdout)
+		return fmt.Errorf("unable to run ffmpeg: %w: %s", err, truncateOutput(stdout))
 	}
 
 	return nil
 }
+
+type AudioFormat struct {
+	SampleRate int
+	Channels   int
+}
+
+// DecodePCM decodes the first maxSeconds of the first audio stream to interleaved signed 16 bit samples,
+// keeping the original sample rate and channels count.
+func DecodePCM(ctx context.Context, audioPath string, maxSeconds int) ([]int16, AudioFormat, error) {
+	probe, err := Probe(ctx, audioPath)
+	if err != nil {
+		return nil, AudioFormat{}, fmt.Errorf("unable to probe audio: %w", err)
+	}
+
+	err = checkLimits(probe)
+	if err != nil {
+		return nil, AudioFormat{}, err
+	}
+
+	stream := probe.AudioStream()
+	if stream == nil {
+		return nil, AudioFormat{}, &ErrNoAudio{}
+	}
+
+	format := AudioFormat{
+		SampleRate: stream.SampleRate,
+		Channels:   stream.Channels,
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd, cmdCtx, cancel := command(ctx, "ffmpeg", "-v", "error", "-i", audioPath, "-map", "0:a:0", "-t", strconv.Itoa(maxSeconds), "-f", "s16le", "-acodec", "pcm_s16le", "-")
+	defer cancel()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmdErr(cmdCtx, cmd.Run())
+	if err != nil {
+		return nil, AudioFormat{}, fmt.Errorf("unable to run ffmpeg: %w: %s", err, truncateOutput(stderr.String()))
+	}
+
+	samples := make([]int16, stdout.Len()/2)
+	err = binary.Read(&stdout, binary.LittleEndian, samples)
+	if err != nil {
+		return nil, AudioFormat{}, fmt.Errorf("unable to read samples: %w", err)
+	}
+
+	return samples, format, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// still tells that all frames of the video look the same, such videos are compared with photos too
+func (h *mediaHash) still() bool {
+	return len(h.Frames) == 1
+}
+
+// getFirstMatchingStillVideoImage finds the first photo similar to the picture of a still video
+func getFirstMatchingStillVideoImage(ctx context.Context, storage Storage, chatID int64, hash *mediaHash, hdist int, minQuality float64, author *AuthorFilter) (*Message, error) {
+	if !hash.still() {
+		return nil, &ErrNotFound{}
+	}
+
+	return storage.GetFirstMatchingMessageByImageHash(ctx, chatID, MediaTypePhoto, hash.Frames[0], hdist, minQuality, author)
+}
+
+// getFirstMatchingStoredStillVideoImage is getFirstMatchingStillVideoImage for an already saved video
+func getFirstMatchingStoredStillVideoImage(ctx context.Context, storage Storage, msg *Message, hdist int, minQuality float64, author *AuthorFilter) (*Message, error) {
+	frames, err := storage.ListMessageFrames(ctx, msg.ChatID, msg.MessageID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list message frames: %w", err)
+	}
+
+	return getFirstMatchingStillVideoImage(ctx, storage, msg.ChatID, &mediaHash{Frames: frames}, hdist, minQuality, author)
+}
@@ -8,7 +8,6 @@ require (
 	github.com/go-fingerprint/fingerprint v0.0.0-20140803133125-29397256b7ff
 	github.com/google/uuid v1.6.0
 	github.com/jmoiron/sqlx v1.4.0
-	github.com/jo-hoe/chromaprint v0.0.0-20240816145029-ca31e331519d
 	github.com/lib/pq v1.10.9
 	github.com/pressly/goose/v3 v3.22.1
 	go.uber.org/multierr v1.11.0
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,6 +10,7 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"log/slog"
+	"math"
 	"mime"
 	"os"
 	"path"
@@ -17,6 +19,7 @@ import (
 	"time"
 
 	"github.com/NinaLeven/MemePolice/fsutils"
+	"github.com/NinaLeven/MemePolice/imageutils"
 	"github.com/NinaLeven/MemePolice/videohash"
 	tg "github.com/OvyFlash/telegram-bot-api"
 	"github.com/corona10/goimagehash"
@@ -26,6 +29,8 @@ type UpdateHandler struct {
 	bot     *tg.BotAPI
 	storage StorageManager
 	assets  Assets
+
+	albums map[albumKey]*pendingAlbum
 }
 
 func NewUpdateHandler(
@@ -37,6 +42,7 @@ func NewUpdateHandler(
 		bot:     bot,
 		storage: storage,
 		assets:  assets,
+		albums:  map[albumKey]*pendingAlbum{},
 	}
 }
 
@@ -131,7 +137,7 @@ func (r *UpdateHandler) OneTimeMigration(ctx context.Context, dataDirectoryPath
 
 	const fileTooBig = "(File exceeds maximum size. Change data exporting settings to download.)"
 
-	getPhotoHash := func(pth string) (*uint64, error) {
+	getPhotoHash := func(pth string) (*mediaHash, error) {
 		if pth == "" || pth == fileTooBig {
 			return nil, nil
 		}
@@ -142,30 +148,31 @@ func (r *UpdateHandler) OneTimeMigration(ctx context.Context, dataDirectoryPath
 		}
 		defer photo.Close()
 
-		img, _, err := image.Decode(photo)
+		img, _, err := imageutils.Decode(photo)
 		if err != nil {
 			return nil, fmt.Errorf("unable to decode image: %w", err)
 		}
 
-		imgHash, err := goimagehash.PerceptionHash(img)
-		if err != nil {
-			return nil, fmt.Errorf("unable to calculate image perception hash: %w", err)
-		}
-
-		return ptr(imgHash.GetHash()), nil
+		return getImageHash(img)
 	}
 
-	getVideoHash := func(mediaType, pth string) (*uint64, *uint64, error) {
+	getVideoHash := func(mediaType, pth string) (*mediaHash, error) {
 		if pth == "" || mediaType != "video_file" || pth == fileTooBig {
-			return nil, nil, nil
+			return nil, nil
 		}
 
-		vHash, aHash, err := videohash.PerceptualHash(path.Join(dataDirectoryPath, pth))
+		hash, err := videohash.PerceptualHash(ctx, path.Join(dataDirectoryPath, pth))
 		if err != nil {
-			return nil, nil, fmt.Errorf("unable to get video perceptual hash: %w", err)
+			return nil, fmt.Errorf("unable to get video perceptual hash: %w", err)
 		}
 
-		return &vHash, &aHash, nil
+		return &mediaHash{
+			VideoVideoHash: &hash.Video,
+			VideoAudioHash: &hash.Audio,
+			FrameSelection: string(hash.FrameSelection),
+			Quality:        &hash.Quality,
+			Frames:         hash.Frames,
+		}, nil
 	}
 
 	processMessage := func(ctx context.Context, storage Storage, msg *message) error {
@@ -173,16 +180,26 @@ func (r *UpdateHandler) OneTimeMigration(ctx context.Context, dataDirectoryPath
 			return nil
 		}
 
-		imgHash, err := getPhotoHash(msg.PhotoPath)
+		photoHash, err := getPhotoHash(msg.PhotoPath)
 		if err != nil {
 			return fmt.Errorf("unable to photo hash: %w", err)
 		}
 
-		vvHash, vaHash, err := getVideoHash(msg.MediaType, msg.FilePath)
+		videoHash, err := getVideoHash(msg.MediaType, msg.FilePath)
 		if err != nil {
 			slog.ErrorContext(ctx, "unable to get video hash", slog.String("err", err.Error()))
 		}
 
+		var mediaType MediaType
+		switch {
+		case photoHash != nil:
+			mediaType = MediaTypePhoto
+		case videoHash != nil:
+			mediaType = MediaTypeVideo
+		}
+
+		media := val(cmp.Or(photoHash, videoHash))
+
 		userId, err := strconv.ParseInt(strings.TrimPrefix(msg.FromID, "user"), 10, 64)
 		if err != nil {
 			slog.ErrorContext(ctx, "unable to pasrse userId", slog.String("err", err.Error()))
@@ -207,9 +224,14 @@ func (r *UpdateHandler) OneTimeMigration(ctx context.Context, dataDirectoryPath
 				},
 				Text: (string(msg.Text))[0:min(len(msg.Text), 4096)],
 			},
-			ImageHash:      imgHash,
-			VideoVideoHash: vvHash,
-			VideoAudioHash: vaHash,
+			MediaType:      mediaType,
+			ImageHash:      media.ImageHash,
+			VideoVideoHash: media.VideoVideoHash,
+			VideoAudioHash: media.VideoAudioHash,
+			FrameSelection: media.FrameSelection,
+			Quality:        media.Quality,
+			DetailHash:     media.DetailHash,
+			HashVersion:    cmp.Or(photoHash, videoHash).version(),
 			CreatedAt:      timestamp,
 			UpdatedAt:      timestamp,
 		})
@@ -217,6 +239,13 @@ func (r *UpdateHandler) OneTimeMigration(ctx context.Context, dataDirectoryPath
 			return fmt.Errorf("unable to upsert message: %w", err)
 		}
 
+		if len(media.Frames) != 0 {
+			err = storage.ReplaceMessageFrames(ctx, chatID, int(msg.ID), media.Frames)
+			if err != nil {
+				return fmt.Errorf("unable to save message frames: %w", err)
+			}
+		}
+
 		return nil
 	}
 
@@ -263,11 +292,21 @@ func (r *UpdateHandler) HandleUpdates(ctx context.Context) error {
 
 	updates := r.bot.GetUpdatesChan(u)
 
+	albumsTicker := time.NewTicker(time.Second)
+	defer albumsTicker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), albumShutdownTimeout)
+			r.flushAlbums(shutdownCtx, 0)
+			cancel()
+
 			return ctx.Err()
 
+		case <-albumsTicker.C:
+			r.flushAlbums(ctx, albumBufferTimeout)
+
 		case update, ok := <-updates:
 			if !ok {
 				slog.InfoContext(ctx, "updates chan closed")
@@ -285,10 +324,15 @@ func (r *UpdateHandler) HandleUpdates(ctx context.Context) error {
 }
 
 func (r *UpdateHandler) handleUpdate(ctx context.Context, update tg.Update) error {
+	var text textFingerprints
+	if update.Message != nil {
+		text = r.getTextFingerprints(ctx, update.Message)
+	}
+
 	err := r.storage.ExecWithTx(ctx, func(ctx context.Context, storage Storage) error {
 		switch {
 		case update.Message != nil:
-			err := r.handleMessage(ctx, storage, update.Message)
+			err := r.handleMessage(ctx, storage, update.Message, text)
 			if err != nil {
 				return fmt.Errorf("unable to handle message: %w", err)
 			}
@@ -334,33 +378,96 @@ func (r *UpdateHandler) handleMessageReaction(ctx context.Context, storage Stora
 	return nil
 }
 
-func (r *UpdateHandler) handleMessage(ctx context.Context, storage Storage, message *tg.Message) error {
+// mediaHash is what is calculated from a message media and stored with it
+type mediaHash struct {
+	ImageHash      *uint64
+	VideoVideoHash *uint64
+	VideoAudioHash *uint64
+	// FrameSelection is how frames were sampled for VideoVideoHash
+	FrameSelection string
+	// Quality is the information score of the hashed image or frames collage
+	Quality *float64
+	// Frames are image hashes of distinct video frames
+	Frames []uint64
+	// DetailHash is a 256 bit image hash that tells apart images of the same template
+	DetailHash []uint64
+}
+
+// version is the hashVersion to store with the hashes, nil when nothing was hashed
+func (h *mediaHash) version() *int {
+	if h == nil {
+		return nil
+	}
+	return ptr(hashVersion)
+}
+
+func (r *UpdateHandler) handleMessage(ctx context.Context, storage Storage, message *tg.Message, text textFingerprints) error {
 	err := r.handleCommand(ctx, storage, message)
 	if err != nil {
 		return fmt.Errorf("unable to handle command: %w", err)
 	}
 
-	var imageHash, videoVideoHash, videoAudioHash *uint64
+	var hash *mediaHash
+	textHash, urls := text.TextHash, text.URLs
 
 	if message.From.ID != r.bot.Self.ID {
-		imageHash, err = r.handleNewPhoto(ctx, storage, message)
+		photoHash, err := r.handleNewPhoto(ctx, storage, message)
 		if err != nil {
 			slog.ErrorContext(ctx, "unable to handle new photo", slog.String("err", err.Error()))
 		}
 
-		videoVideoHash, videoAudioHash, err = r.handleNewVideo(ctx, storage, message)
+		videoHash, err := r.handleNewVideo(ctx, storage, message)
 		if err != nil {
 			slog.ErrorContext(ctx, "unable to handle new video", slog.String("err", err.Error()))
 		}
+
+		animationHash, err := r.handleNewAnimation(ctx, storage, message)
+		if err != nil {
+			slog.ErrorContext(ctx, "unable to handle new animation", slog.String("err", err.Error()))
+		}
+
+		documentHash, err := r.handleNewDocument(ctx, storage, message)
+		if err != nil {
+			slog.ErrorContext(ctx, "unable to handle new document", slog.String("err", err.Error()))
+		}
+
+		stickerHash, err := r.handleNewSticker(ctx, storage, message)
+		if err != nil {
+			slog.ErrorContext(ctx, "unable to handle new sticker", slog.String("err", err.Error()))
+		}
+
+		// a message has at most one kind of media
+		hash = cmp.Or(photoHash, videoHash, animationHash, documentHash, stickerHash)
+
+		// captions of hashed media are only stored, the media itself is the meme
+		if hash == nil {
+			err = r.checkTextRepost(ctx, storage, message, textHash, urls)
+			if err != nil {
+				slog.ErrorContext(ctx, "unable to check text repost", slog.String("err", err.Error()))
+			}
+		}
+
+		if message.MediaGroupID != "" && hash != nil {
+			r.addAlbumItem(message, nil)
+		}
 	}
 
+	media := val(hash)
+
 	err = storage.UpsertMessage(ctx, Message{
 		MessageID:      message.MessageID,
 		ChatID:         message.Chat.ID,
 		Raw:            *message,
-		ImageHash:      imageHash,
-		VideoVideoHash: videoVideoHash,
-		VideoAudioHash: videoAudioHash,
+		MediaType:      messageMediaType(message),
+		ImageHash:      media.ImageHash,
+		VideoVideoHash: media.VideoVideoHash,
+		VideoAudioHash: media.VideoAudioHash,
+		FrameSelection: media.FrameSelection,
+		Quality:        media.Quality,
+		DetailHash:     media.DetailHash,
+		HashVersion:    hash.version(),
+		TextHash:       textHash,
+		URLs:           urls,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	})
@@ -368,6 +475,21 @@ func (r *UpdateHandler) handleMessage(ctx context.Context, storage Storage, mess
 		return fmt.Errorf("unable to save message image hash: %w", err)
 	}
 
+	if len(media.Frames) != 0 {
+		err = storage.ReplaceMessageFrames(ctx, message.Chat.ID, message.MessageID, media.Frames)
+		if err != nil {
+			return fmt.Errorf("unable to save message frames: %w", err)
+		}
+	}
+
+	// reposts have already joined the cluster of their match, the rest start a cluster of their own
+	if hash != nil || textHash != nil || len(urls) != 0 {
+		err = storage.CreateMemeCluster(ctx, message.Chat.ID, message.MessageID)
+		if err != nil {
+			return fmt.Errorf("unable to save message meme cluster: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -389,6 +511,72 @@ func (r *UpdateHandler) handleCommand(ctx context.Context, storage Storage, mess
 			return fmt.Errorf("unable to handle amend: %w", err)
 		}
 
+	case "amends":
+		err := r.handleAmends(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle amends: %w", err)
+		}
+
+	case "repost":
+		err := r.handleRepost(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle repost: %w", err)
+		}
+
+	case "unrepost":
+		err := r.handleUnrepost(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle unrepost: %w", err)
+		}
+
+	case "allow":
+		err := r.handleAllow(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle allow: %w", err)
+		}
+
+	case "disallow":
+		err := r.handleDisallow(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle disallow: %w", err)
+		}
+
+	case "allowlist":
+		err := r.handleAllowlist(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle allowlist: %w", err)
+		}
+
+	case "ban":
+		err := r.handleBan(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle ban: %w", err)
+		}
+
+	case "unban":
+		err := r.handleUnban(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle unban: %w", err)
+		}
+
+	case "banlist":
+		err := r.handleBanList(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle ban list: %w", err)
+		}
+
+	case "banexport":
+		err := r.handleBanExport(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle ban export: %w", err)
+		}
+
+	case "banimport":
+		err := r.handleBanImport(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle ban import: %w", err)
+		}
+
 	case "topkek":
 		err := r.handleCreateTopkek(ctx, storage, message)
 		if err != nil {
@@ -431,6 +619,84 @@ func (r *UpdateHandler) handleCommand(ctx context.Context, storage Storage, mess
 			return fmt.Errorf("unable to handle chat settings video hamming distance: %w", err)
 		}
 
+	case "setstickers":
+		err := r.handleChatSettingsStickerDetection(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings sticker detection: %w", err)
+		}
+
+	case "settxthdist":
+		err := r.handleChatSettingsTextHammingDistance(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings text hamming distance: %w", err)
+		}
+
+	case "setminquality":
+		err := r.handleChatSettingsMinImageQuality(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings min image quality: %w", err)
+		}
+
+	case "settmplhdist":
+		err := r.handleChatSettingsTemplateHammingDistance(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings template hamming distance: %w", err)
+		}
+
+	case "settmpldetail":
+		err := r.handleChatSettingsTemplateDetailDistance(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings template detail distance: %w", err)
+		}
+
+	case "setbanwarn":
+		err := r.handleChatSettingsBanWarning(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings ban warning: %w", err)
+		}
+
+	case "setrepeatdays":
+		err := r.handleChatSettingsRepeatedDays(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings repeated days: %w", err)
+		}
+
+	case "setforgivedays":
+		err := r.handleChatSettingsForgivenDays(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings forgiven days: %w", err)
+		}
+
+	case "setselfgrace":
+		err := r.handleChatSettingsSelfRepostGrace(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings self repost grace: %w", err)
+		}
+
+	case "setignoreself":
+		err := r.handleChatSettingsIgnoreSelfReposts(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle chat settings ignore self reposts: %w", err)
+		}
+
+	case "history":
+		err := r.handleHistory(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle history: %w", err)
+		}
+
+	case "stats":
+		err := r.handleStats(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle stats: %w", err)
+		}
+
+	case "templates":
+		err := r.handleTemplates(ctx, storage, message)
+		if err != nil {
+			return fmt.Errorf("unable to handle templates: %w", err)
+		}
+
 	case "help":
 		err := r.handleHelp(ctx, storage, message)
 		if err != nil {
@@ -453,7 +719,7 @@ func (r *UpdateHandler) handleAmend(ctx context.Context, storage Storage, messag
 		return nil
 	}
 
-	_, err = storage.GetMessage(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
+	amendedMsg, err := storage.GetMessage(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
 	if err != nil && !errors.Is(err, &ErrNotFound{}) {
 		return fmt.Errorf("unable to get message hash by id: %w", err)
 	}
@@ -465,11 +731,21 @@ func (r *UpdateHandler) handleAmend(ctx context.Context, storage Storage, messag
 		return nil
 	}
 
+	err = saveMatchFeedback(ctx, storage, message, amendedMsg)
+	if err != nil {
+		return fmt.Errorf("unable to save match feedback: %w", err)
+	}
+
 	err = r.unsendReaction(ctx, storage, message.Chat.ID, message.ReplyToMessage.MessageID)
 	if err != nil {
 		return fmt.Errorf("unable to unsend message reaction: %w", err)
 	}
 
+	err = leaveMemeCluster(ctx, storage, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil {
+		return fmt.Errorf("unable to leave meme cluster: %w", err)
+	}
+
 	return nil
 }
 
@@ -499,14 +775,70 @@ func (r *UpdateHandler) handleWhyCommand(ctx context.Context, storage Storage, m
 		return fmt.Errorf("unable to get or create chat settings: %w", err)
 	}
 
+	manualMatch, err := storage.GetManualMatch(ctx, message.Chat.ID, repeatedMsg.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get manual match: %w", err)
+	}
+	if err == nil {
+		var manualOrigMsg *Message
+		manualOrigMsg, err = storage.GetMessage(ctx, message.Chat.ID, manualMatch.OriginalMessageID)
+		if err != nil {
+			return fmt.Errorf("unable to get manual match original: %w", err)
+		}
+		return r.sendWhyReply(ctx, storage, message, repeatedMsg, manualOrigMsg,
+			"отмечено вручную, "+describeRepost(chatSettings, manualOrigMsg, repeatedMsg.CreatedAt))
+	}
+
+	// reposts are reported against the first message of their meme cluster
+	clusterOrigMsg, err := storage.GetMemeClusterOrigin(ctx, message.Chat.ID, repeatedMsg.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get meme cluster origin: %w", err)
+	}
+	if err == nil && clusterOrigMsg.MessageID != repeatedMsg.MessageID {
+		return r.sendWhyReply(ctx, storage, message, repeatedMsg, clusterOrigMsg, describeRepost(chatSettings, clusterOrigMsg, repeatedMsg.CreatedAt))
+	}
+
+	if repeatedMsg.Quality != nil && *repeatedMsg.Quality < chatSettings.MinImageQuality {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID,
+			fmt.Sprintf("слишком мало деталей для сравнения: качество %.2f, минимум %.2f", *repeatedMsg.Quality, chatSettings.MinImageQuality))
+		if err != nil {
+			return fmt.Errorf("unable to send low quality reply: %w", err)
+		}
+		return nil
+	}
+
 	var origMsg *Message
+	replyText := "."
+	author := selfRepostFilter(chatSettings, &repeatedMsg.Raw)
 
 	switch {
+	case repeatedMsg.ImageHash != nil && repeatedMsg.MediaType == MediaTypePhoto:
+		var match *imageMatch
+		match, err = findImageRepostOrTemplate(ctx, storage, message.Chat.ID, &repeatedMsg.Raw, &mediaHash{
+			ImageHash:  repeatedMsg.ImageHash,
+			DetailHash: repeatedMsg.DetailHash,
+		}, chatSettings, author)
+		if err == nil {
+			origMsg, replyText, err = match.origin()
+		}
+
 	case repeatedMsg.ImageHash != nil:
-		origMsg, err = storage.GetFirstMatchingMessageByImageHash(ctx, message.Chat.ID, *repeatedMsg.ImageHash, chatSettings.ImageHammingDistance)
+		origMsg, err = storage.GetFirstMatchingMessageByImageHash(ctx, message.Chat.ID, repeatedMsg.MediaType, *repeatedMsg.ImageHash, chatSettings.ImageHammingDistance, chatSettings.MinImageQuality, author)
+
+	case (repeatedMsg.MediaType == MediaTypeAnimation || repeatedMsg.MediaType == MediaTypeSticker) && repeatedMsg.VideoVideoHash != nil:
+		origMsg, err = storage.GetFirstMatchingMessageByFramesHash(ctx, message.Chat.ID, repeatedMsg.MediaType, *repeatedMsg.VideoVideoHash, repeatedMsg.FrameSelection, chatSettings.VideoHammingDistance, chatSettings.MinImageQuality, author)
+
+	case repeatedMsg.MediaType == MediaTypeSticker && repeatedMsg.Raw.Sticker != nil:
+		origMsg, err = storage.GetFirstMatchingStickerMessage(ctx, message.Chat.ID, *repeatedMsg.Raw.Sticker, author)
+
+	case len(repeatedMsg.URLs) != 0:
+		origMsg, err = storage.GetFirstMatchingMessageByURLs(ctx, message.Chat.ID, repeatedMsg.URLs, author)
+
+	case repeatedMsg.TextHash != nil:
+		origMsg, err = storage.GetFirstMatchingMessageByTextHash(ctx, message.Chat.ID, *repeatedMsg.TextHash, chatSettings.TextHammingDistance, author)
 
 	case repeatedMsg.VideoVideoHash != nil && repeatedMsg.VideoAudioHash != nil:
-		origMsg, err = storage.GetFirstMatchingMessageByVideoHash(ctx, message.Chat.ID, *repeatedMsg.VideoVideoHash, *repeatedMsg.VideoAudioHash, chatSettings.VideoHammingDistance)
+		origMsg, err = storage.GetFirstMatchingMessageByVideoHash(ctx, message.Chat.ID, *repeatedMsg.VideoVideoHash, *repeatedMsg.VideoAudioHash, repeatedMsg.FrameSelection, chatSettings.VideoHammingDistance, chatSettings.MinImageQuality, author)
 
 	default:
 		err = r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_repeat", r.assets.GetAudioNoRepeat())
@@ -515,6 +847,24 @@ func (r *UpdateHandler) handleWhyCommand(ctx context.Context, storage Storage, m
 		}
 		return nil
 	}
+	// the author filter leaves out the message itself too
+	if errors.Is(err, &ErrNotFound{}) && author != nil {
+		origMsg, err = repeatedMsg, nil
+	}
+	if err == nil && isAlbumSibling(&repeatedMsg.Raw, origMsg) {
+		origMsg = repeatedMsg
+	}
+	isOwnMatch := err == nil && origMsg.MessageID == repeatedMsg.MessageID
+	if (errors.Is(err, &ErrNotFound{}) || isOwnMatch) && (repeatedMsg.MediaType == MediaTypeVideo || repeatedMsg.MediaType == MediaTypeAnimation) {
+		var stillOrigMsg *Message
+		stillOrigMsg, err = getFirstMatchingStoredStillVideoImage(ctx, storage, repeatedMsg, chatSettings.ImageHammingDistance, chatSettings.MinImageQuality, author)
+		if err == nil && !isAlbumSibling(&repeatedMsg.Raw, stillOrigMsg) {
+			origMsg = stillOrigMsg
+		}
+		if isOwnMatch && errors.Is(err, &ErrNotFound{}) {
+			err = nil
+		}
+	}
 	if err != nil && !errors.Is(err, &ErrNotFound{}) {
 		return fmt.Errorf("unable to get first matching message image hash: %w", err)
 	}
@@ -525,7 +875,12 @@ func (r *UpdateHandler) handleWhyCommand(ctx context.Context, storage Storage, m
 		}
 		return nil
 	}
-	if origMsg.MessageID == repeatedMsg.MessageID {
+	repeatedKind, repeatedHash := repeatedMsg.fingerprint()
+	amended, err := isAmendedMatch(ctx, storage, origMsg, repeatedKind, repeatedHash)
+	if err != nil {
+		return fmt.Errorf("unable to check amended match: %w", err)
+	}
+	if origMsg.MessageID == repeatedMsg.MessageID || amended {
 		err = r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_repeat", r.assets.GetAudioNoRepeat())
 		if err != nil {
 			return fmt.Errorf("unable to send no_repeat voice message %w", err)
@@ -533,7 +888,17 @@ func (r *UpdateHandler) handleWhyCommand(ctx context.Context, storage Storage, m
 		return nil
 	}
 
-	_, err = r.sendMessageReply(ctx, message.Chat.ID, origMsg.MessageID, ".")
+	// templates are not reposts, so only reposts are told by age
+	if replyText == "." {
+		replyText = describeRepost(chatSettings, origMsg, repeatedMsg.CreatedAt)
+	}
+
+	return r.sendWhyReply(ctx, storage, message, repeatedMsg, origMsg, replyText)
+}
+
+// sendWhyReply replies to the original message, so that the chat can jump to it
+func (r *UpdateHandler) sendWhyReply(ctx context.Context, storage Storage, message *tg.Message, repeatedMsg, origMsg *Message, replyText string) error {
+	_, _, err := r.replyToOrigin(ctx, storage, message.Chat.ID, repeatedMsg.MessageID, origMsg, replyText)
 	if err != nil && !errors.Is(err, &ErrNotFound{}) {
 		return fmt.Errorf("unable to reply with text: %w", err)
 	}
@@ -555,80 +920,109 @@ func (r *UpdateHandler) handleWhyCommand(ctx context.Context, storage Storage, m
 
 const deleteAutoReplyTimeout = time.Hour
 
-func (r *UpdateHandler) handleNewVideo(ctx context.Context, storage Storage, message *tg.Message) (*uint64, *uint64, error) {
+func (r *UpdateHandler) handleNewVideo(ctx context.Context, storage Storage, message *tg.Message) (*mediaHash, error) {
 	if message.Video == nil {
-		return nil, nil, nil
+		return nil, nil
 	}
 	if message.Video.FileSize > 1024*1024*120 {
 		slog.WarnContext(ctx, "video too big", slog.Int64("size", message.Video.FileSize))
-		return nil, nil, nil
+		return nil, nil
 	}
 
-	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	hash, err := r.getTelegramVideoHash(ctx, message.Video.FileID, message.Video.MimeType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get telegram video hash: %w", err)
+	}
+
+	err = r.checkVideoRepost(ctx, storage, message, hash)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to get or create chat settings: %w", err)
+		return hash, fmt.Errorf("unable to check video repost: %w", err)
 	}
 
+	return hash, nil
+}
+
+func (r *UpdateHandler) getTelegramVideoHash(ctx context.Context, fileID, mimeType string) (*mediaHash, error) {
 	tempDir, err := fsutils.GetTempDir()
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to get temp dir: %w", err)
+		return nil, fmt.Errorf("unable to get temp dir: %w", err)
 	}
 	defer fsutils.CleanupTempDir(tempDir)
 
-	ext, err := mime.ExtensionsByType(message.Video.MimeType)
+	ext, err := mime.ExtensionsByType(mimeType)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to determine mime type: %s: %w", message.Video.MimeType, err)
+		return nil, fmt.Errorf("unable to determine mime type: %s: %w", mimeType, err)
 	}
 	if len(ext) == 0 {
-		return nil, nil, fmt.Errorf("unknown mime type: %s", message.Video.MimeType)
+		return nil, fmt.Errorf("unknown mime type: %s", mimeType)
 	}
 
 	tempVideoPath := path.Join(tempDir, "video"+ext[0])
 
-	err = r.getTelegramVideo(ctx, message.Video.FileID, tempVideoPath)
+	err = r.getTelegramVideo(ctx, fileID, tempVideoPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to get telegram video: %w", err)
+		return nil, fmt.Errorf("unable to get telegram video: %w", err)
 	}
 
-	videoHash, audioHash, err := videohash.PerceptualHash(tempVideoPath)
+	hash, err := videohash.PerceptualHash(ctx, tempVideoPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to calculate video perception hash: %w", err)
+		return nil, fmt.Errorf("unable to calculate video perception hash: %w", err)
 	}
 
-	origMessage, err := storage.GetFirstMatchingMessageByVideoHash(ctx, message.Chat.ID, videoHash, audioHash, chatSettings.VideoHammingDistance)
-	if err != nil && !errors.Is(err, &ErrNotFound{}) {
-		return &videoHash, &audioHash, fmt.Errorf("unable to get lash matching message video hash: %w", err)
-	}
-	if err != nil && errors.Is(err, &ErrNotFound{}) || origMessage.MessageID == message.MessageID {
-		return &videoHash, &audioHash, nil
-	}
+	return &mediaHash{
+		VideoVideoHash: &hash.Video,
+		VideoAudioHash: &hash.Audio,
+		FrameSelection: string(hash.FrameSelection),
+		Quality:        &hash.Quality,
+		Frames:         hash.Frames,
+	}, nil
+}
 
-	err = r.sendReaction(ctx, storage, message.Chat.ID, message.MessageID, RepeatedMemeEmoji)
+func (r *UpdateHandler) checkVideoRepost(ctx context.Context, storage Storage, message *tg.Message, hash *mediaHash) error {
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
 	if err != nil {
-		return &videoHash, &audioHash, fmt.Errorf("unable to send stale meme reaction: %w", err)
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
 	}
 
-	replyID, err := r.sendMessageReply(ctx, message.Chat.ID, origMessage.MessageID, ".")
+	banned, err := r.deleteBannedMeme(ctx, storage, message, chatSettings, hash.matchKind(), hash.fingerprint())
 	if err != nil {
-		return &videoHash, &audioHash, fmt.Errorf("unable to send stale meme reply: %w", err)
+		return fmt.Errorf("unable to delete banned meme: %w", err)
+	}
+	if banned {
+		return nil
 	}
 
-	go func() {
-		select {
-		case <-time.After(deleteAutoReplyTimeout):
-		case <-ctx.Done():
-		}
-		err := r.deleteMessage(ctx, message.Chat.ID, replyID)
-		if err != nil {
-			slog.ErrorContext(ctx, "unable to delete reply", slog.String("err", err.Error()))
-		}
-	}()
+	if isLowQuality(ctx, chatSettings, hash) {
+		return nil
+	}
+
+	author := selfRepostFilter(chatSettings, message)
+
+	origMessage, err := storage.GetFirstMatchingMessageByVideoHash(ctx, message.Chat.ID, *hash.VideoVideoHash, *hash.VideoAudioHash, hash.FrameSelection, chatSettings.VideoHammingDistance, chatSettings.MinImageQuality, author)
+	if err != nil && errors.Is(err, &ErrNotFound{}) {
+		origMessage, err = getFirstMatchingStillVideoImage(ctx, storage, message.Chat.ID, hash, chatSettings.ImageHammingDistance, chatSettings.MinImageQuality, author)
+	}
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get lash matching message video hash: %w", err)
+	}
+	if err != nil && errors.Is(err, &ErrNotFound{}) || origMessage.MessageID == message.MessageID || isAlbumSibling(message, origMessage) {
+		return nil
+	}
+
+	err = r.reportRepost(ctx, storage, message, hash.matchKind(), hash.fingerprint(), origMessage)
+	if err != nil {
+		return fmt.Errorf("unable to report repost: %w", err)
+	}
 
-	return &videoHash, &audioHash, nil
+	return nil
 }
 
-func (r *UpdateHandler) handleNewPhoto(ctx context.Context, storage Storage, message *tg.Message) (*uint64, error) {
-	if len(message.Photo) == 0 {
+func (r *UpdateHandler) handleNewAnimation(ctx context.Context, storage Storage, message *tg.Message) (*mediaHash, error) {
+	if message.Animation == nil {
+		return nil, nil
+	}
+	if message.Animation.FileSize > 1024*1024*120 {
+		slog.WarnContext(ctx, "animation too big", slog.Int64("size", message.Animation.FileSize))
 		return nil, nil
 	}
 
@@ -637,6 +1031,85 @@ func (r *UpdateHandler) handleNewPhoto(ctx context.Context, storage Storage, mes
 		return nil, fmt.Errorf("unable to get or create chat settings: %w", err)
 	}
 
+	hash, err := r.getTelegramAnimationHash(ctx, message.Animation)
+	if err != nil {
+		return nil, err
+	}
+
+	banned, err := r.deleteBannedMeme(ctx, storage, message, chatSettings, hash.matchKind(), hash.fingerprint())
+	if err != nil {
+		return hash, fmt.Errorf("unable to delete banned meme: %w", err)
+	}
+	if banned {
+		return hash, nil
+	}
+
+	if isLowQuality(ctx, chatSettings, hash) {
+		return hash, nil
+	}
+
+	author := selfRepostFilter(chatSettings, message)
+
+	origMessage, err := storage.GetFirstMatchingMessageByFramesHash(ctx, message.Chat.ID, MediaTypeAnimation, *hash.VideoVideoHash, hash.FrameSelection, chatSettings.VideoHammingDistance, chatSettings.MinImageQuality, author)
+	if err != nil && errors.Is(err, &ErrNotFound{}) {
+		origMessage, err = getFirstMatchingStillVideoImage(ctx, storage, message.Chat.ID, hash, chatSettings.ImageHammingDistance, chatSettings.MinImageQuality, author)
+	}
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return hash, fmt.Errorf("unable to get first matching message animation hash: %w", err)
+	}
+	if err != nil && errors.Is(err, &ErrNotFound{}) || origMessage.MessageID == message.MessageID || isAlbumSibling(message, origMessage) {
+		return hash, nil
+	}
+
+	err = r.reportRepost(ctx, storage, message, hash.matchKind(), hash.fingerprint(), origMessage)
+	if err != nil {
+		return hash, fmt.Errorf("unable to report repost: %w", err)
+	}
+
+	return hash, nil
+}
+
+func (r *UpdateHandler) getTelegramAnimationHash(ctx context.Context, animation *tg.Animation) (*mediaHash, error) {
+	tempDir, err := fsutils.GetTempDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get temp dir: %w", err)
+	}
+	defer fsutils.CleanupTempDir(tempDir)
+
+	ext, err := mime.ExtensionsByType(animation.MimeType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine mime type: %s: %w", animation.MimeType, err)
+	}
+	if len(ext) == 0 {
+		return nil, fmt.Errorf("unknown mime type: %s", animation.MimeType)
+	}
+
+	tempAnimationPath := path.Join(tempDir, "animation"+ext[0])
+
+	err = r.getTelegramVideo(ctx, animation.FileID, tempAnimationPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get telegram animation: %w", err)
+	}
+
+	// gifs are silent, so only the frames are hashed
+	videoHash, err := videohash.PerceptualVideoHash(ctx, tempAnimationPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to calculate animation perception hash: %w", err)
+	}
+
+	return &mediaHash{
+		VideoVideoHash: &videoHash.Video,
+		FrameSelection: string(videoHash.FrameSelection),
+		Quality:        &videoHash.Quality,
+		Frames:         videoHash.Frames,
+	}, nil
+}
+
+func (r *UpdateHandler) handleNewPhoto(ctx context.Context, storage Storage, message *tg.Message) (*mediaHash, error) {
+	if len(message.Photo) == 0 {
+		return nil, nil
+	}
+
 	// photo with max resolution
 	photo := message.Photo[len(message.Photo)-1]
 
@@ -645,27 +1118,153 @@ func (r *UpdateHandler) handleNewPhoto(ctx context.Context, storage Storage, mes
 		return nil, fmt.Errorf("unable to get telegram photo: %w", err)
 	}
 
+	hash, err := getImageHash(img)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.checkImageRepost(ctx, storage, message, hash)
+	if err != nil {
+		return hash, fmt.Errorf("unable to check image repost: %w", err)
+	}
+
+	return hash, nil
+}
+
+// getImageHash calculates perceptual hash and quality of an image
+func getImageHash(img image.Image) (*mediaHash, error) {
 	imgHash, err := goimagehash.PerceptionHash(img)
 	if err != nil {
 		return nil, fmt.Errorf("unable to calculate image perception hash: %w", err)
 	}
 
-	origMessage, err := storage.GetFirstMatchingMessageByImageHash(ctx, message.Chat.ID, imgHash.GetHash(), chatSettings.ImageHammingDistance)
-	if err != nil && !errors.Is(err, &ErrNotFound{}) {
-		return ptr(imgHash.GetHash()), fmt.Errorf("unable to get lash matching message image hash: %w", err)
+	detailHash, err := goimagehash.ExtPerceptionHash(img, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("unable to calculate image detail hash: %w", err)
 	}
-	if err != nil && errors.Is(err, &ErrNotFound{}) || origMessage.MessageID == message.MessageID {
-		return ptr(imgHash.GetHash()), nil
+
+	return &mediaHash{
+		ImageHash:  ptr(imgHash.GetHash()),
+		Quality:    ptr(imageutils.Quality(img)),
+		DetailHash: detailHash.GetHash(),
+	}, nil
+}
+
+// isLowQuality tells that the media has too little detail for its hash to trigger automatic reactions
+func isLowQuality(ctx context.Context, chatSettings *ChatSettings, hash *mediaHash) bool {
+	if hash.Quality == nil || *hash.Quality >= chatSettings.MinImageQuality {
+		return false
 	}
 
-	err = r.sendReaction(ctx, storage, message.Chat.ID, message.MessageID, RepeatedMemeEmoji)
+	slog.InfoContext(ctx, "low quality media is not checked for reposts",
+		slog.Float64("quality", *hash.Quality),
+		slog.Float64("min_quality", chatSettings.MinImageQuality),
+	)
+
+	return true
+}
+
+func (r *UpdateHandler) checkImageRepost(ctx context.Context, storage Storage, message *tg.Message, hash *mediaHash) error {
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	banned, err := r.deleteBannedMeme(ctx, storage, message, chatSettings, hash.matchKind(), hash.fingerprint())
+	if err != nil {
+		return fmt.Errorf("unable to delete banned meme: %w", err)
+	}
+	if banned {
+		return nil
+	}
+
+	if isLowQuality(ctx, chatSettings, hash) {
+		return nil
+	}
+
+	match, err := findImageRepostOrTemplate(ctx, storage, message.Chat.ID, message, hash, chatSettings, selfRepostFilter(chatSettings, message))
+	if err != nil {
+		return fmt.Errorf("unable to find image repost or template: %w", err)
+	}
+	if match.Repost == nil && match.Template != nil {
+		return saveTemplateRelation(ctx, storage, message, match)
+	}
+	if match.Repost == nil {
+		return nil
+	}
+
+	err = r.reportRepost(ctx, storage, message, hash.matchKind(), hash.fingerprint(), match.Repost, match.Similar...)
+	if err != nil {
+		return fmt.Errorf("unable to report repost: %w", err)
+	}
+
+	return nil
+}
+
+// reportRepost joins the message to the meme cluster of the matched message and the similar ones,
+// the repost is reported against the first message of the cluster
+func (r *UpdateHandler) reportRepost(ctx context.Context, storage Storage, message *tg.Message, kind *MatchKind, hash []uint64, origMessage *Message, similar ...*Message) error {
+	amended, err := isAmendedMatch(ctx, storage, origMessage, kind, hash)
+	if err != nil {
+		return fmt.Errorf("unable to check amended match: %w", err)
+	}
+	if amended {
+		return nil
+	}
+
+	origMessage, err = joinMemeCluster(ctx, storage, message.Chat.ID, message.MessageID, append([]*Message{origMessage}, similar...))
+	if err != nil {
+		return fmt.Errorf("unable to join meme cluster: %w", err)
+	}
+	if origMessage.MessageID == message.MessageID {
+		return nil
+	}
+
+	// allowed memes are clustered as usual, so that /history and /stats see them, but are never reported
+	allowed, err := storage.IsAllowedMeme(ctx, message.Chat.ID, message.MessageID)
 	if err != nil {
-		return ptr(imgHash.GetHash()), fmt.Errorf("unable to send stale meme reaction: %w", err)
+		return fmt.Errorf("unable to check allowed meme: %w", err)
+	}
+	if allowed {
+		slog.InfoContext(ctx, "allowed meme is not reported",
+			slog.Int64("chat_id", message.Chat.ID),
+			slog.Int("message_id", message.MessageID),
+		)
+		return nil
 	}
 
-	replyID, err := r.sendMessageReply(ctx, message.Chat.ID, origMessage.MessageID, ".")
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
 	if err != nil {
-		return ptr(imgHash.GetHash()), fmt.Errorf("unable to send stale meme reply: %w", err)
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	verdict := classifyRepost(chatSettings, origMessage, message.Time())
+	if verdict == repostForgiven {
+		slog.InfoContext(ctx, "forgiven meme is not reported",
+			slog.Int64("chat_id", message.Chat.ID),
+			slog.Int("message_id", message.MessageID),
+			slog.Int("original_message_id", origMessage.MessageID),
+		)
+		return nil
+	}
+
+	// albums get a single verdict once all of their messages arrive
+	if message.MediaGroupID != "" {
+		r.addAlbumItem(message, origMessage)
+		return nil
+	}
+
+	err = r.sendReaction(ctx, storage, message.Chat.ID, message.MessageID, verdict.emoji())
+	if err != nil {
+		return fmt.Errorf("unable to send stale meme reaction: %w", err)
+	}
+
+	replyID, _, err := r.replyToOrigin(ctx, storage, message.Chat.ID, message.MessageID, origMessage, ".")
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to send stale meme reply: %w", err)
+	}
+	if err != nil {
+		return nil
 	}
 
 	go func() {
@@ -679,7 +1278,7 @@ func (r *UpdateHandler) handleNewPhoto(ctx context.Context, storage Storage, mes
 		}
 	}()
 
-	return ptr(imgHash.GetHash()), nil
+	return nil
 }
 
 func (r *UpdateHandler) getOrCreateChatSettings(ctx context.Context, storage Storage, chatID int64) (*ChatSettings, error) {
@@ -705,13 +1304,40 @@ func formatChatSettings(settings ChatSettings) string {
 	return fmt.Sprintf(`Настройки чата:
 * Минимум реакций для попадания в топкек: %d
 * Расстояние хэмминга для схожести изображений: %d
-* Расстояние хэмминга для схожести видео: %d`,
+* Расстояние хэмминга для схожести видео: %d
+* Поиск повторных стикеров: %s
+* Расстояние хэмминга для схожести текстов: %d
+* Минимальное качество изображений для проверки: %.2f
+* Расстояние хэмминга для шаблонов изображений: %d
+* Расстояние деталей для другого текста шаблона: %d
+* Предупреждение при удалении запрещенных мемов: %s
+* Повтор, если оригиналу не больше дней: %d
+* Не реагировать, если оригиналу больше дней: %s
+* Автор может повторить свой мем в течение минут: %d
+* Не считать повторами мемы автора: %s`,
 		settings.MinReactions,
 		settings.ImageHammingDistance,
 		settings.VideoHammingDistance,
+		formatBool(settings.StickerDetection),
+		settings.TextHammingDistance,
+		settings.MinImageQuality,
+		settings.TemplateHammingDistance,
+		settings.TemplateDetailDistance,
+		formatBool(settings.BanWarning),
+		settings.RepeatedDays,
+		formatForgivenDays(settings.ForgivenDays),
+		settings.SelfRepostGraceMinutes,
+		formatBool(settings.IgnoreSelfReposts),
 	)
 }
 
+func formatBool(v bool) string {
+	if v {
+		return "вкл"
+	}
+	return "выкл"
+}
+
 func (r *UpdateHandler) handleChatSettings(ctx context.Context, storage Storage, message *tg.Message) error {
 	err := r.sendOutChatSettings(ctx, storage, message.Chat.ID)
 	if err != nil {
@@ -823,3 +1449,37 @@ func (r *UpdateHandler) handleChatSettingsVideoHammingDistamce(ctx context.Conte
 
 	return nil
 }
+
+func (r *UpdateHandler) handleChatSettingsMinImageQuality(ctx context.Context, storage Storage, message *tg.Message) error {
+	quality, err := strconv.ParseFloat(strings.Trim(message.CommandArguments(), " "), 64)
+	if err == nil && (math.IsNaN(quality) || math.IsInf(quality, 0)) {
+		err = fmt.Errorf("not a finite number: %v", quality)
+	}
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть числом")
+		if err != nil {
+			return fmt.Errorf("unable to send float parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	// quality is an entropy of 8 bit luminance
+	chatSettings.MinImageQuality = min(8, max(0, quality))
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package imageutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// Limits reject decompression bombs: small files that decode into huge images
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+}
+
+var DefaultLimits = Limits{
+	MaxWidth:  10000,
+	MaxHeight: 10000,
+	MaxPixels: 40_000_000,
+}
+
+var limits = DefaultLimits
+
+// SetLimits is not safe to call concurrently with decoding, call it on startup
+func SetLimits(l Limits) {
+	limits = l
+}
+
+type ErrImageTooLarge struct {
+	Width  int
+	Height int
+}
+
+func (e *ErrImageTooLarge) Error() string {
+	return fmt.Sprintf("image too large: %dx%d", e.Width, e.Height)
+}
+
+func (e *ErrImageTooLarge) Is(target error) bool {
+	_, ok := target.(*ErrImageTooLarge)
+	return ok
+}
+
+type ErrUnsupportedFormat struct {
+	Err error
+}
+
+func (e *ErrUnsupportedFormat) Error() string {
+	return fmt.Sprintf("unsupported image format: %s", e.Err.Error())
+}
+
+func (e *ErrUnsupportedFormat) Is(target error) bool {
+	_, ok := target.(*ErrUnsupportedFormat)
+	return ok
+}
+
+func (e *ErrUnsupportedFormat) Unwrap() error {
+	return e.Err
+}
+
+func checkLimits(cfg image.Config) error {
+	if cfg.Width <= 0 || cfg.Height <= 0 ||
+		limits.MaxWidth > 0 && cfg.Width > limits.MaxWidth ||
+		limits.MaxHeight > 0 && cfg.Height > limits.MaxHeight ||
+		limits.MaxPixels > 0 && cfg.Width*cfg.Height > limits.MaxPixels {
+		return &ErrImageTooLarge{
+			Width:  cfg.Width,
+			Height: cfg.Height,
+		}
+	}
+	return nil
+}
+
+// Decode is image.Decode which checks the image size from the header before allocating pixels
+func Decode(r io.Reader) (image.Image, string, error) {
+	var header bytes.Buffer
+
+	cfg, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, "", &ErrUnsupportedFormat{Err: err}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to decode image config: %w", err)
+	}
+
+	err = checkLimits(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	img, format, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to decode %s image: %w", format, err)
+	}
+
+	return img, format, nil
+}
+
+func DecodeFile(imagePath string) (image.Image, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open image: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := Decode(file)
+	return img, err
+}
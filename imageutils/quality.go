@@ -0,0 +1,44 @@
+package imageutils
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// qualitySamples is the grid size the image is sampled with
+const qualitySamples = 128
+
+// Quality scores how much information an image has as the entropy of its luminance histogram in bits, 0 to 8.
+// Uniform images like black screens score 0 and their perceptual hashes collide with each other.
+func Quality(img image.Image) float64 {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return 0
+	}
+
+	stepX := max(1, bounds.Dx()/qualitySamples)
+	stepY := max(1, bounds.Dy()/qualitySamples)
+
+	var histogram [256]int
+	total := 0
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+			histogram[gray.Y]++
+			total++
+		}
+	}
+
+	entropy := 0.0
+	for _, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
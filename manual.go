@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+// parseMessageRef accepts a message id or a message link, e.g. https://t.me/c/123/456
+func parseMessageRef(arg string) (int, bool) {
+	arg = strings.TrimRight(strings.Trim(arg, " "), "/")
+	if i := strings.LastIndex(arg, "/"); i != -1 {
+		arg = arg[i+1:]
+	}
+	// links to messages in topics and comments have a query
+	arg, _, _ = strings.Cut(arg, "?")
+
+	id, err := strconv.Atoi(arg)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// handleRepost links the replied message to its original given by the argument,
+// or to the message the replied message itself replies to
+func (r *UpdateHandler) handleRepost(ctx context.Context, storage Storage, message *tg.Message) error {
+	if message.ReplyToMessage == nil {
+		err := r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_reply", r.assets.GetAudioNoRererence())
+		if err != nil {
+			return fmt.Errorf("unable to send no_reply voice message %w", err)
+		}
+		return nil
+	}
+
+	repost := message.ReplyToMessage
+
+	originalID, ok := parseMessageRef(message.CommandArguments())
+	if !ok && repost.ReplyToMessage != nil {
+		originalID, ok = repost.ReplyToMessage.MessageID, true
+	}
+	if !ok {
+		_, err := r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "надо указать оригинал: ссылкой, номером сообщения или реплаем повтора на оригинал")
+		if err != nil {
+			return fmt.Errorf("unable to send no original reply: %w", err)
+		}
+		return nil
+	}
+	if originalID >= repost.MessageID {
+		_, err := r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "оригинал должен быть раньше повтора")
+		if err != nil {
+			return fmt.Errorf("unable to send late original reply: %w", err)
+		}
+		return nil
+	}
+
+	_, err := storage.GetMessage(ctx, message.Chat.ID, repost.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get repost message: %w", err)
+	}
+	if err != nil {
+		err = r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_repeat", r.assets.GetAudioNoRepeat())
+		if err != nil {
+			return fmt.Errorf("unable to send no_repeat voice message %w", err)
+		}
+		return nil
+	}
+
+	original, err := storage.GetMessage(ctx, message.Chat.ID, originalID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get original message: %w", err)
+	}
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "не знаю такого оригинала")
+		if err != nil {
+			return fmt.Errorf("unable to send unknown original reply: %w", err)
+		}
+		return nil
+	}
+
+	err = storage.UpsertManualMatch(ctx, ManualMatch{
+		ChatID:            message.Chat.ID,
+		MessageID:         repost.MessageID,
+		OriginalMessageID: originalID,
+		AuthorID:          message.From.ID,
+		CreatedAt:         time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save manual match: %w", err)
+	}
+
+	_, err = joinMemeCluster(ctx, storage, message.Chat.ID, repost.MessageID, []*Message{original})
+	if err != nil {
+		return fmt.Errorf("unable to join meme cluster: %w", err)
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	// a repost linked by hand is reported even when the original is old enough to be forgiven
+	emoji := cmp.Or(classifyRepost(chatSettings, original, repost.Time()).emoji(), StaleMemeEmoji)
+
+	err = r.sendReaction(ctx, storage, message.Chat.ID, repost.MessageID, emoji)
+	if err != nil {
+		return fmt.Errorf("unable to send repeated meme reaction: %w", err)
+	}
+
+	return nil
+}
+
+// handleUnrepost revokes a manual match of the replied message, only chat admins can do it
+func (r *UpdateHandler) handleUnrepost(ctx context.Context, storage Storage, message *tg.Message) error {
+	if message.ReplyToMessage == nil {
+		err := r.sendVoiceMessageReply(ctx, message.Chat.ID, message.MessageID, "no_reply", r.assets.GetAudioNoRererence())
+		if err != nil {
+			return fmt.Errorf("unable to send no_reply voice message %w", err)
+		}
+		return nil
+	}
+
+	isAdmin, err := r.checkAdmin(ctx, message)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	_, err = storage.GetManualMatch(ctx, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get manual match: %w", err)
+	}
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "это сообщение не отмечали вручную")
+		if err != nil {
+			return fmt.Errorf("unable to send no manual match reply: %w", err)
+		}
+		return nil
+	}
+
+	err = storage.RevokeManualMatch(ctx, message.Chat.ID, message.ReplyToMessage.MessageID, message.From.ID)
+	if err != nil {
+		return fmt.Errorf("unable to revoke manual match: %w", err)
+	}
+
+	err = r.unsendReaction(ctx, storage, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil {
+		return fmt.Errorf("unable to unsend message reaction: %w", err)
+	}
+
+	err = leaveMemeCluster(ctx, storage, message.Chat.ID, message.ReplyToMessage.MessageID)
+	if err != nil {
+		return fmt.Errorf("unable to leave meme cluster: %w", err)
+	}
+
+	return nil
+}
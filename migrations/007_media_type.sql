@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table message add column media_type text default null;
+
+update message
+set media_type = 'photo'
+where image_hash is not null;
+
+update message
+set media_type = 'video'
+where video_video_hash is not null
+	and video_audio_hash is not null;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
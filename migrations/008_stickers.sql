@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table chat_settings add column sticker_detection boolean not null default false;
+
+create index message_sticker_unique_id_idx on message using btree (chat_id, (data->'sticker'->>'file_unique_id')) where media_type = 'sticker';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
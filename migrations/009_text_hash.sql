@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table message add column text_hash bigint default null;
+alter table message add column urls text[] default null;
+
+CREATE INDEX bk_message_text_hash_idx ON message USING spgist (text_hash bktree_ops) where text_hash is not null;
+create index message_urls_idx on message using gin (urls) where urls is not null;
+
+alter table chat_settings add column text_hamming_distance int not null default 3;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
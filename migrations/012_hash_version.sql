@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- hashes stored before versioning are left without a version, so that the rehash job recomputes them
+alter table message add column hash_version int default null;
+
+create table rehash_job (
+    hash_version int primary key,
+    last_chat_id bigint default null,
+    last_message_id bigint default null,
+    total int not null default 0,
+    processed int not null default 0,
+    skipped int not null default 0,
+    failed int not null default 0,
+    started_at timestamp not null,
+    updated_at timestamp not null,
+    finished_at timestamp default null
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+
+create table message_frame (
+    chat_id bigint not null,
+    message_id bigint not null,
+    frame_index int not null,
+    hash bigint not null,
+    hash_version int not null,
+    primary key (chat_id, message_id, frame_index)
+);
+
+CREATE INDEX bk_message_frame_hash_idx ON message_frame USING spgist (hash bktree_ops);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table message add column detail_hash bigint[] default null;
+
+alter table chat_settings add column template_hamming_distance int not null default 10;
+
+create table meme_template (
+    chat_id bigint not null,
+    message_id bigint not null,
+    template_message_id bigint not null,
+    image_distance int not null,
+    detail_distance int not null,
+    created_at timestamp not null,
+    primary key (chat_id, message_id)
+);
+
+create index meme_template_template_idx on meme_template using btree(chat_id, template_message_id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+
+create table meme_cluster (
+    chat_id bigint not null,
+    message_id bigint not null,
+    cluster_id bigint not null,
+    created_at timestamp not null,
+    primary key (chat_id, message_id)
+);
+
+create index meme_cluster_cluster_idx on meme_cluster using btree(chat_id, cluster_id);
+
+-- every already hashed message starts as its own cluster, clusters merge as new reposts bridge them
+insert into meme_cluster(chat_id, message_id, cluster_id, created_at)
+select chat_id, message_id, message_id, created_at
+from message
+where image_hash is not null
+    or video_video_hash is not null
+    or text_hash is not null
+    or urls is not null;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+
+create table match_feedback (
+    chat_id bigint not null,
+    message_id bigint not null,
+    original_message_id bigint not null,
+    kind text default null,
+    hash bigint[] default null,
+    original_hash bigint[] default null,
+    distance int default null,
+    author_id bigint not null,
+    created_at timestamp not null,
+    primary key (chat_id, message_id, original_message_id)
+);
+
+create index match_feedback_original_idx on match_feedback using btree(chat_id, original_message_id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+
+create table manual_match (
+    chat_id bigint not null,
+    message_id bigint not null,
+    original_message_id bigint not null,
+    author_id bigint not null,
+    created_at timestamp not null,
+    revoked_by bigint default null,
+    revoked_at timestamp default null,
+    primary key (chat_id, message_id)
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+create table allowed_meme (
+    chat_id bigint not null,
+    message_id bigint not null,
+    author_id bigint not null,
+    created_at timestamp not null,
+    primary key (chat_id, message_id)
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
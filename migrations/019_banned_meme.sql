@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+
+create table banned_meme (
+    id serial not null primary key,
+    chat_id bigint not null,
+    kind text not null,
+    hash bigint[] not null,
+    hash_version int not null,
+    source_message_id bigint default null,
+    author_id bigint not null,
+    created_at timestamp not null
+);
+
+create unique index banned_meme_hash_idx on banned_meme using btree(chat_id, kind, hash, hash_version);
+
+alter table chat_settings add column ban_warning bool not null default true;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table chat_settings add column repeated_days int not null default 30;
+alter table chat_settings add column forgiven_days int not null default 0;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table message add column author_id bigint default null;
+
+update message set author_id = (data->'from'->>'id')::bigint
+where data->'from'->>'id' is not null;
+
+alter table chat_settings add column self_repost_grace_minutes int not null default 10;
+alter table chat_settings add column ignore_self_reposts bool not null default false;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table message add column deleted_at timestamp default null;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+
+alter table chat_settings add column template_detail_distance int not null default 6;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+select 1;
+-- +goose StatementEnd
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	tg "github.com/OvyFlash/telegram-bot-api"
@@ -45,21 +46,92 @@ func (e *ErrNotFound) As(target interface{}) bool {
 	return errors.As(e.Err, target)
 }
 
+// ErrReplyTargetNotFound is a reply to a message that is gone from the chat, it is also ErrNotFound
+type ErrReplyTargetNotFound struct {
+	Err error
+}
+
+func (e *ErrReplyTargetNotFound) Error() string {
+	if e.Err == nil {
+		return "message to be replied not found"
+	}
+	return fmt.Sprintf("message to be replied not found: %s", e.Err.Error())
+}
+
+func (e *ErrReplyTargetNotFound) Is(target error) bool {
+	switch target.(type) {
+	case *ErrReplyTargetNotFound, *ErrNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *ErrReplyTargetNotFound) Unwrap() error {
+	return e.Err
+}
+
 const (
 	StaleMemeEmoji    = "🥱"
 	RepeatedMemeEmoji = "✍️"
 	OKEmoji           = "👌"
 )
 
+type MediaType string
+
+const (
+	MediaTypePhoto     MediaType = "photo"
+	MediaTypeVideo     MediaType = "video"
+	MediaTypeAnimation MediaType = "animation"
+	MediaTypeSticker   MediaType = "sticker"
+)
+
+func messageMediaType(message *tg.Message) MediaType {
+	switch {
+	case len(message.Photo) > 0:
+		return MediaTypePhoto
+	case message.Animation != nil:
+		return MediaTypeAnimation
+	case message.Video != nil:
+		return MediaTypeVideo
+	case message.Sticker != nil:
+		return MediaTypeSticker
+	case message.Document != nil && strings.HasPrefix(message.Document.MimeType, "image/"):
+		return MediaTypePhoto
+	case message.Document != nil && strings.HasPrefix(message.Document.MimeType, "video/"):
+		return MediaTypeVideo
+	default:
+		return ""
+	}
+}
+
+// hashVersion tags stored media hashes, hashes of different versions are never matched.
+// Bump it on any change of image, video or audio hashing that changes the hashes of the same media,
+// the rehash job then recomputes stored hashes in the background
+const hashVersion = 1
+
 type Message struct {
 	MessageID      int
 	ChatID         int64
 	Raw            tg.Message
+	MediaType      MediaType
 	ImageHash      *uint64
 	VideoVideoHash *uint64
 	VideoAudioHash *uint64
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
+	TextHash       *uint64
+	URLs           []string
+	// FrameSelection is how frames were sampled for VideoVideoHash, only hashes with the same selection are comparable
+	FrameSelection string
+	// Quality is the information score of the image or frames collage
+	Quality *float64
+	// DetailHash is a 256 bit perceptual hash of the image, it tells apart images of the same template
+	DetailHash []uint64
+	// HashVersion is the hashVersion media hashes were calculated with, nil for messages without them
+	HashVersion *int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// DeletedAt is when a reply to the message failed as it is gone from the chat
+	DeletedAt *time.Time
 }
 
 type MessageReactions struct {
@@ -80,15 +152,32 @@ type ListMessagesWithReactionCountOptions struct {
 
 type Storage interface {
 	UpsertMessage(ctx context.Context, msg Message) error
-	GetFirstMatchingMessageByImageHash(ctx context.Context, chatID int64, hash uint64, hdist int) (*Message, error)
-	GetLastMatchingMessageByImageHash(ctx context.Context, chatID int64, hash uint64, hdist int) (*Message, error)
-	GetFirstMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, hdist int) (*Message, error)
-	GetLastMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, hdist int) (*Message, error)
+	ListMatchingMessagesByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int, minQuality float64, limit int, author *AuthorFilter) ([]Message, error)
+	GetFirstMatchingMessageByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int, minQuality float64, author *AuthorFilter) (*Message, error)
+	GetLastMatchingMessageByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int) (*Message, error)
+	GetFirstMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, frameSelection string, hdist int, minQuality float64, author *AuthorFilter) (*Message, error)
+	GetLastMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, frameSelection string, hdist int) (*Message, error)
+	GetFirstMatchingMessageByFramesHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, frameSelection string, hdist int, minQuality float64, author *AuthorFilter) (*Message, error)
+	GetLastMatchingMessageByFramesHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, frameSelection string, hdist int) (*Message, error)
+	GetFirstMatchingStickerMessage(ctx context.Context, chatID int64, sticker tg.Sticker, author *AuthorFilter) (*Message, error)
+	GetFirstMatchingMessageByTextHash(ctx context.Context, chatID int64, hash uint64, hdist int, author *AuthorFilter) (*Message, error)
+	GetLastMatchingMessageByTextHash(ctx context.Context, chatID int64, hash uint64, hdist int) (*Message, error)
+	GetFirstMatchingMessageByURLs(ctx context.Context, chatID int64, urls []string, author *AuthorFilter) (*Message, error)
 	GetMessage(ctx context.Context, chatID int64, messageID int) (*Message, error)
+	ListMediaGroupMessages(ctx context.Context, chatID int64, mediaGroupID string) ([]Message, error)
+	ReplaceMessageFrames(ctx context.Context, chatID int64, messageID int, frames []uint64) error
+	ListMessageFrames(ctx context.Context, chatID int64, messageID int) ([]uint64, error)
+	GetFirstMatchingMessageByFrameHash(ctx context.Context, chatID int64, hash uint64, hdist int, minQuality float64, author *AuthorFilter) (*Message, error)
 
 	UpsertMessageReactions(ctx context.Context, msg MessageReactions) error
 	ListMessagesWithReactionCount(ctx context.Context, opts ListMessagesWithReactionCountOptions) ([]Message, error)
 
+	UpdateMessageHashes(ctx context.Context, msg Message) error
+	CountMessagesToRehash(ctx context.Context, hashVersion int) (int, error)
+	ListMessagesToRehash(ctx context.Context, hashVersion int, after *RehashCursor, limit int) ([]Message, error)
+	GetRehashJob(ctx context.Context, hashVersion int) (*RehashJob, error)
+	UpsertRehashJob(ctx context.Context, job RehashJob) error
+
 	SetLastUpdateID(ctx context.Context, lastUpdateID int) error
 	GetLastUpdateID(ctx context.Context) (int, error)
 
@@ -100,6 +189,40 @@ type Storage interface {
 	GetTopkekMessages(ctx context.Context, topkekID int64) ([]TopkekMessage, error)
 	DeleteTopkekMessages(ctx context.Context, topkekID int64) error
 
+	UpsertTemplateRelation(ctx context.Context, relation TemplateRelation) error
+	GetTemplateRelation(ctx context.Context, chatID int64, messageID int) (*TemplateRelation, error)
+	ListTopTemplates(ctx context.Context, chatID int64, limit int) ([]TemplateStats, error)
+
+	GetMemeClusterID(ctx context.Context, chatID int64, messageID int) (int, error)
+	CreateMemeCluster(ctx context.Context, chatID int64, messageID int) error
+	UpsertMemeClusterMember(ctx context.Context, member MemeClusterMember) error
+	MergeMemeClusters(ctx context.Context, chatID int64, fromClusterID, toClusterID int) error
+	// GetMemeClusterOrigin is the first message of the cluster, tombstoned or not
+	GetMemeClusterOrigin(ctx context.Context, chatID int64, messageID int) (*Message, error)
+	// GetMemeClusterSurvivingOrigin is the first message of the cluster that is not tombstoned
+	GetMemeClusterSurvivingOrigin(ctx context.Context, chatID int64, messageID int) (*Message, error)
+	ListMemeClusterMessages(ctx context.Context, chatID int64, clusterID int) ([]Message, error)
+	MarkMessageDeleted(ctx context.Context, chatID int64, messageID int, deletedAt time.Time) error
+	ListTopMemeClusters(ctx context.Context, chatID int64, limit int) ([]MemeClusterStats, error)
+
+	UpsertMatchFeedback(ctx context.Context, feedback MatchFeedback) error
+	ListOriginalMatchFeedback(ctx context.Context, chatID int64, originalMessageID int) ([]MatchFeedback, error)
+	ListMatchFeedback(ctx context.Context, chatID int64) ([]MatchFeedback, error)
+
+	UpsertManualMatch(ctx context.Context, match ManualMatch) error
+	GetManualMatch(ctx context.Context, chatID int64, messageID int) (*ManualMatch, error)
+	ListManualMatches(ctx context.Context, chatID int64, messageIDs []int) ([]ManualMatch, error)
+	RevokeManualMatch(ctx context.Context, chatID int64, messageID int, revokedBy int64) error
+
+	UpsertAllowedMeme(ctx context.Context, meme AllowedMeme) error
+	IsAllowedMeme(ctx context.Context, chatID int64, messageID int) (bool, error)
+	DeleteAllowedMemes(ctx context.Context, chatID int64, messageID int) (int, error)
+	ListAllowedMemes(ctx context.Context, chatID int64) ([]AllowedMeme, error)
+
+	CreateBannedMeme(ctx context.Context, meme BannedMeme) (bool, error)
+	ListBannedMemes(ctx context.Context, chatID int64) ([]BannedMeme, error)
+	DeleteBannedMeme(ctx context.Context, chatID int64, id int64) (bool, error)
+
 	UpsertChatSettings(ctx context.Context, settings ChatSettings) error
 	GetChatSettings(ctx context.Context, chatID int64) (*ChatSettings, error)
 }
@@ -116,6 +239,111 @@ type Assets interface {
 	GetAudioNoRepeat() []byte
 }
 
+// RehashCursor is the last message the rehash job has processed, messages are processed in chat_id, message_id order
+type RehashCursor struct {
+	ChatID    int64
+	MessageID int
+}
+
+type RehashJob struct {
+	HashVersion int
+	Cursor      *RehashCursor
+	Total       int
+	Processed   int
+	Skipped     int
+	Failed      int
+	StartedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  *time.Time
+}
+
+// TemplateRelation links an image to the first image of the same template with different details
+type TemplateRelation struct {
+	ChatID            int64 `db:"chat_id"`
+	MessageID         int   `db:"message_id"`
+	TemplateMessageID int   `db:"template_message_id"`
+	// ImageDistance and DetailDistance are distances between image and detail hashes of the two images
+	ImageDistance  int       `db:"image_distance"`
+	DetailDistance int       `db:"detail_distance"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+type TemplateStats struct {
+	TemplateMessageID int       `db:"template_message_id"`
+	Uses              int       `db:"uses"`
+	LastUsedAt        time.Time `db:"last_used_at"`
+}
+
+// MemeClusterMember puts a message into a family of near duplicates,
+// the cluster id is the message id of the first message of the family
+type MemeClusterMember struct {
+	ChatID    int64
+	MessageID int
+	ClusterID int
+	CreatedAt time.Time
+}
+
+type MemeClusterStats struct {
+	ClusterID  int       `db:"cluster_id"`
+	Size       int       `db:"size"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+}
+
+// MatchKind is the hash a match is made by, every kind has its own hamming distance setting
+type MatchKind string
+
+const (
+	MatchKindImage MatchKind = "image"
+	MatchKindVideo MatchKind = "video"
+	MatchKindText  MatchKind = "text"
+)
+
+// MatchFeedback is a match amended as a false positive, hashes closer to it than to the original are not matched with the original again
+type MatchFeedback struct {
+	ChatID            int64
+	MessageID         int
+	OriginalMessageID int
+	// Kind, Hash and OriginalHash are empty for matches by stickers or urls
+	Kind         *MatchKind
+	Hash         []uint64
+	OriginalHash []uint64
+	// Distance is the largest hamming distance of the hashes, nil when the hashes are not comparable
+	Distance  *int
+	AuthorID  int64
+	CreatedAt time.Time
+}
+
+// ManualMatch is a repost flagged by a chat member with /repost, revoked ones are kept for the record
+type ManualMatch struct {
+	ChatID            int64      `db:"chat_id"`
+	MessageID         int        `db:"message_id"`
+	OriginalMessageID int        `db:"original_message_id"`
+	AuthorID          int64      `db:"author_id"`
+	CreatedAt         time.Time  `db:"created_at"`
+	RevokedBy         *int64     `db:"revoked_by"`
+	RevokedAt         *time.Time `db:"revoked_at"`
+}
+
+// AllowedMeme lets the meme cluster of the message be reposted without a reaction
+type AllowedMeme struct {
+	ChatID    int64     `db:"chat_id"`
+	MessageID int       `db:"message_id"`
+	AuthorID  int64     `db:"author_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// BannedMeme is a hash whose near matches are deleted on sight, SourceMessageID is nil for imported hashes
+type BannedMeme struct {
+	ID              int64
+	ChatID          int64
+	Kind            MatchKind
+	Hash            []uint64
+	HashVersion     int
+	SourceMessageID *int
+	AuthorID        int64
+	CreatedAt       time.Time
+}
+
 type TopkekStatus string
 
 const (
@@ -153,10 +381,17 @@ type TopkekMessage struct {
 
 func defaultChatSettings(chatID int64) ChatSettings {
 	return ChatSettings{
-		ChatID:               chatID,
-		MinReactions:         5,
-		ImageHammingDistance: 3,
-		VideoHammingDistance: 11,
+		ChatID:                  chatID,
+		MinReactions:            5,
+		ImageHammingDistance:    3,
+		VideoHammingDistance:    11,
+		TextHammingDistance:     3,
+		MinImageQuality:         2,
+		TemplateHammingDistance: 10,
+		TemplateDetailDistance:  6,
+		BanWarning:              true,
+		RepeatedDays:            30,
+		SelfRepostGraceMinutes:  10,
 	}
 }
 
@@ -165,4 +400,29 @@ type ChatSettings struct {
 	MinReactions         int   `db:"min_reactions"`
 	ImageHammingDistance int   `db:"image_hamming_distance"`
 	VideoHammingDistance int   `db:"video_hamming_distance"`
+	StickerDetection     bool  `db:"sticker_detection"`
+	TextHammingDistance  int   `db:"text_hamming_distance"`
+	// MinImageQuality is the least information score of images and video frames that are checked for reposts
+	MinImageQuality float64 `db:"min_image_quality"`
+	// TemplateHammingDistance is the looser image distance within which images with different details share a template
+	TemplateHammingDistance int `db:"template_hamming_distance"`
+	// TemplateDetailDistance separates detail hashes of re-encoded copies of an image from images of the same template
+	// with a different text
+	TemplateDetailDistance int `db:"template_detail_distance"`
+	// BanWarning tells the poster why their banned meme was deleted
+	BanWarning bool `db:"ban_warning"`
+	// RepeatedDays is how old the original of a repeated meme may be, reposts of older ones are stale
+	RepeatedDays int `db:"repeated_days"`
+	// ForgivenDays is the age of the original after which reposts are not reported, 0 never forgives
+	ForgivenDays int `db:"forgiven_days"`
+	// SelfRepostGraceMinutes is how long the author may post their meme again, e.g. to fix a caption
+	SelfRepostGraceMinutes int `db:"self_repost_grace_minutes"`
+	// IgnoreSelfReposts never matches messages with earlier messages of their author
+	IgnoreSelfReposts bool `db:"ignore_self_reposts"`
+}
+
+// AuthorFilter leaves the messages of the author posted since the time out of matches, a zero time leaves out all of them
+type AuthorFilter struct {
+	AuthorID int64
+	Since    time.Time
 }
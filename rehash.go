@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+// rehashBatchPause spreads telegram downloads of the rehash job so it does not compete with new messages
+const rehashBatchPause = time.Second * 5
+
+// Rehash recomputes media hashes stored with an older hashVersion from the file ids of the stored messages.
+// Progress is saved after every batch, so a restarted job continues after the last processed message.
+func (r *UpdateHandler) Rehash(ctx context.Context, batchSize int) error {
+	job, err := r.getOrCreateRehashJob(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get or create rehash job: %w", err)
+	}
+
+	if job.FinishedAt != nil {
+		return nil
+	}
+
+	slog.InfoContext(ctx, "rehashing messages",
+		slog.Int("hash_version", job.HashVersion),
+		slog.Int("total", job.Total),
+		slog.Int("processed", job.Processed),
+	)
+
+	for {
+		messages, err := r.storage.ListMessagesToRehash(ctx, job.HashVersion, job.Cursor, batchSize)
+		if err != nil {
+			return fmt.Errorf("unable to list messages to rehash: %w", err)
+		}
+
+		if len(messages) == 0 {
+			job.FinishedAt = ptr(time.Now().UTC())
+			job.UpdatedAt = time.Now().UTC()
+
+			err = r.storage.UpsertRehashJob(ctx, *job)
+			if err != nil {
+				return fmt.Errorf("unable to finish rehash job: %w", err)
+			}
+
+			slog.InfoContext(ctx, "rehash done",
+				slog.Int("hash_version", job.HashVersion),
+				slog.Int("processed", job.Processed),
+				slog.Int("skipped", job.Skipped),
+				slog.Int("failed", job.Failed),
+			)
+
+			return nil
+		}
+
+		for _, msg := range messages {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			err := r.rehashMessage(ctx, msg)
+			switch {
+			case err == nil:
+				job.Processed++
+			case errors.Is(err, &ErrNotFound{}):
+				job.Skipped++
+			default:
+				job.Failed++
+				slog.WarnContext(ctx, "unable to rehash message",
+					slog.Int64("chat_id", msg.ChatID),
+					slog.Int("message_id", msg.MessageID),
+					slog.String("err", err.Error()),
+				)
+			}
+
+			job.Cursor = &RehashCursor{
+				ChatID:    msg.ChatID,
+				MessageID: msg.MessageID,
+			}
+		}
+
+		job.UpdatedAt = time.Now().UTC()
+
+		err = r.storage.UpsertRehashJob(ctx, *job)
+		if err != nil {
+			return fmt.Errorf("unable to save rehash job progress: %w", err)
+		}
+
+		slog.InfoContext(ctx, "rehash progress",
+			slog.Int("hash_version", job.HashVersion),
+			slog.Int("total", job.Total),
+			slog.Int("processed", job.Processed),
+			slog.Int("skipped", job.Skipped),
+			slog.Int("failed", job.Failed),
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(rehashBatchPause):
+		}
+	}
+}
+
+func (r *UpdateHandler) getOrCreateRehashJob(ctx context.Context) (*RehashJob, error) {
+	job, err := r.storage.GetRehashJob(ctx, hashVersion)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return nil, fmt.Errorf("unable to get rehash job: %w", err)
+	}
+	if err == nil {
+		return job, nil
+	}
+
+	total, err := r.storage.CountMessagesToRehash(ctx, hashVersion)
+	if err != nil {
+		return nil, fmt.Errorf("unable to count messages to rehash: %w", err)
+	}
+
+	job = &RehashJob{
+		HashVersion: hashVersion,
+		Total:       total,
+		StartedAt:   time.Now().UTC(),
+		UpdatedAt:   time.Now().UTC(),
+	}
+
+	err = r.storage.UpsertRehashJob(ctx, *job)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create rehash job: %w", err)
+	}
+
+	return job, nil
+}
+
+// rehashMessage returns ErrNotFound for messages without downloadable media,
+// e.g. the ones imported from a chat export
+func (r *UpdateHandler) rehashMessage(ctx context.Context, msg Message) error {
+	hash, err := r.getMessageMediaHash(ctx, &msg.Raw)
+	if err != nil {
+		return fmt.Errorf("unable to get message media hash: %w", err)
+	}
+	if hash == nil {
+		return &ErrNotFound{}
+	}
+
+	err = r.storage.UpdateMessageHashes(ctx, Message{
+		ChatID:         msg.ChatID,
+		MessageID:      msg.MessageID,
+		ImageHash:      hash.ImageHash,
+		VideoVideoHash: hash.VideoVideoHash,
+		VideoAudioHash: hash.VideoAudioHash,
+		FrameSelection: hash.FrameSelection,
+		Quality:        hash.Quality,
+		DetailHash:     hash.DetailHash,
+		HashVersion:    hash.version(),
+		UpdatedAt:      time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update message hashes: %w", err)
+	}
+
+	err = r.storage.ReplaceMessageFrames(ctx, msg.ChatID, msg.MessageID, hash.Frames)
+	if err != nil {
+		return fmt.Errorf("unable to update message frames: %w", err)
+	}
+
+	return nil
+}
+
+// getMessageMediaHash hashes the message media the same way new messages are hashed, without repost checks
+func (r *UpdateHandler) getMessageMediaHash(ctx context.Context, message *tg.Message) (*mediaHash, error) {
+	switch {
+	case len(message.Photo) > 0:
+		img, err := r.getTelegramImage(ctx, message.Photo[len(message.Photo)-1].FileID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get telegram photo: %w", err)
+		}
+		return getImageHash(img)
+
+	case message.Video != nil:
+		return r.getTelegramVideoHash(ctx, message.Video.FileID, message.Video.MimeType)
+
+	case message.Animation != nil:
+		return r.getTelegramAnimationHash(ctx, message.Animation)
+
+	case message.Sticker != nil && message.Sticker.IsVideo:
+		return r.getTelegramVideoStickerHash(ctx, message.Sticker)
+
+	case message.Sticker != nil && !message.Sticker.IsAnimated:
+		return r.getTelegramStickerHash(ctx, message.Sticker)
+
+	case message.Document != nil && strings.HasPrefix(message.Document.MimeType, "image/"):
+		img, err := r.getTelegramDocumentImage(ctx, message.Document)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get telegram document image: %w", err)
+		}
+		return getImageHash(img)
+
+	case message.Document != nil && strings.HasPrefix(message.Document.MimeType, "video/"):
+		return r.getTelegramVideoHash(ctx, message.Document.FileID, message.Document.MimeType)
+
+	default:
+		return nil, nil
+	}
+}
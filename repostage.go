@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+type repostVerdict int
+
+const (
+	repostRepeated repostVerdict = iota
+	repostStale
+	repostForgiven
+)
+
+// repostAgeDays is how many whole days passed between the original and the repost
+func repostAgeDays(origMsg *Message, repostedAt time.Time) int {
+	return max(0, int(repostedAt.Sub(origMsg.CreatedAt)/(24*time.Hour)))
+}
+
+// classifyRepost tells a fresh repeat from a stale one by the age of the original,
+// reposts of originals older than the forgiven age are not reported at all
+func classifyRepost(settings *ChatSettings, origMsg *Message, repostedAt time.Time) repostVerdict {
+	days := repostAgeDays(origMsg, repostedAt)
+	switch {
+	case settings.ForgivenDays > 0 && days > settings.ForgivenDays:
+		return repostForgiven
+	case days > settings.RepeatedDays:
+		return repostStale
+	default:
+		return repostRepeated
+	}
+}
+
+// emoji is empty for forgiven reposts
+func (v repostVerdict) emoji() string {
+	switch v {
+	case repostRepeated:
+		return RepeatedMemeEmoji
+	case repostStale:
+		return StaleMemeEmoji
+	default:
+		return ""
+	}
+}
+
+// describeRepost is the /why reply about the repost age
+func describeRepost(settings *ChatSettings, origMsg *Message, repostedAt time.Time) string {
+	days := repostAgeDays(origMsg, repostedAt)
+	switch classifyRepost(settings, origMsg, repostedAt) {
+	case repostStale:
+		return fmt.Sprintf("%s баян, оригиналу %d дн., повтором считается до %d дн.", StaleMemeEmoji, days, settings.RepeatedDays)
+	case repostForgiven:
+		return fmt.Sprintf("прощено, оригиналу %d дн., прощается после %d дн.", days, settings.ForgivenDays)
+	default:
+		return fmt.Sprintf("%s повтор, оригиналу %d дн.", RepeatedMemeEmoji, days)
+	}
+}
+
+func formatForgivenDays(days int) string {
+	if days <= 0 {
+		return "никогда"
+	}
+	return strconv.Itoa(days)
+}
+
+func (r *UpdateHandler) handleChatSettingsRepeatedDays(ctx context.Context, storage Storage, message *tg.Message) error {
+	days, err := strconv.Atoi(strings.Trim(message.CommandArguments(), " "))
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть числом")
+		if err != nil {
+			return fmt.Errorf("unable to send int parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.RepeatedDays = max(0, days)
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
+
+// handleChatSettingsForgivenDays sets the forgiven age, 0 never forgives
+func (r *UpdateHandler) handleChatSettingsForgivenDays(ctx context.Context, storage Storage, message *tg.Message) error {
+	days, err := strconv.Atoi(strings.Trim(message.CommandArguments(), " "))
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть числом")
+		if err != nil {
+			return fmt.Errorf("unable to send int parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.ForgivenDays = max(0, days)
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
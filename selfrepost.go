@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+// selfRepostFilter leaves out earlier messages of the poster that the chat does not count as reposted:
+// all of them when self reposts are ignored, otherwise those within the grace period
+func selfRepostFilter(settings *ChatSettings, message *tg.Message) *AuthorFilter {
+	if message.From == nil {
+		return nil
+	}
+
+	switch {
+	case settings.IgnoreSelfReposts:
+		return &AuthorFilter{AuthorID: message.From.ID}
+	case settings.SelfRepostGraceMinutes > 0:
+		return &AuthorFilter{
+			AuthorID: message.From.ID,
+			Since:    message.Time().Add(-time.Duration(settings.SelfRepostGraceMinutes) * time.Minute),
+		}
+	default:
+		return nil
+	}
+}
+
+func (r *UpdateHandler) handleChatSettingsSelfRepostGrace(ctx context.Context, storage Storage, message *tg.Message) error {
+	minutes, err := strconv.Atoi(strings.Trim(message.CommandArguments(), " "))
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть числом")
+		if err != nil {
+			return fmt.Errorf("unable to send int parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.SelfRepostGraceMinutes = max(0, minutes)
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleChatSettingsIgnoreSelfReposts(ctx context.Context, storage Storage, message *tg.Message) error {
+	enabled, err := parseBoolArgument(message.CommandArguments())
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть on или off")
+		if err != nil {
+			return fmt.Errorf("unable to send bool parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.IgnoreSelfReposts = enabled
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
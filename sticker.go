@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/NinaLeven/MemePolice/fsutils"
+	"github.com/NinaLeven/MemePolice/videohash"
+	tg "github.com/OvyFlash/telegram-bot-api"
+	_ "golang.org/x/image/webp"
+)
+
+// handleNewSticker returns image hash for static webp stickers and frames hash for video stickers.
+// Animated (tgs) stickers are not hashed and are matched by file_unique_id or by set name and emoji.
+func (r *UpdateHandler) handleNewSticker(ctx context.Context, storage Storage, message *tg.Message) (*mediaHash, error) {
+	if message.Sticker == nil {
+		return nil, nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	if !chatSettings.StickerDetection {
+		return nil, nil
+	}
+
+	sticker := message.Sticker
+
+	var (
+		hash        *mediaHash
+		origMessage *Message
+	)
+
+	switch {
+	case sticker.IsVideo:
+		hash, err = r.getTelegramVideoStickerHash(ctx, sticker)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get video sticker hash: %w", err)
+		}
+
+		banned, err := r.deleteBannedMeme(ctx, storage, message, chatSettings, hash.matchKind(), hash.fingerprint())
+		if err != nil {
+			return hash, fmt.Errorf("unable to delete banned meme: %w", err)
+		}
+		if banned {
+			return hash, nil
+		}
+
+		if isLowQuality(ctx, chatSettings, hash) {
+			return hash, nil
+		}
+
+		origMessage, err = storage.GetFirstMatchingMessageByFramesHash(ctx, message.Chat.ID, MediaTypeSticker, *hash.VideoVideoHash, hash.FrameSelection, chatSettings.VideoHammingDistance, chatSettings.MinImageQuality, selfRepostFilter(chatSettings, message))
+
+	case sticker.IsAnimated:
+		origMessage, err = storage.GetFirstMatchingStickerMessage(ctx, message.Chat.ID, *sticker, selfRepostFilter(chatSettings, message))
+
+	default:
+		hash, err = r.getTelegramStickerHash(ctx, sticker)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get sticker hash: %w", err)
+		}
+
+		banned, err := r.deleteBannedMeme(ctx, storage, message, chatSettings, hash.matchKind(), hash.fingerprint())
+		if err != nil {
+			return hash, fmt.Errorf("unable to delete banned meme: %w", err)
+		}
+		if banned {
+			return hash, nil
+		}
+
+		if isLowQuality(ctx, chatSettings, hash) {
+			return hash, nil
+		}
+
+		origMessage, err = storage.GetFirstMatchingMessageByImageHash(ctx, message.Chat.ID, MediaTypeSticker, *hash.ImageHash, chatSettings.ImageHammingDistance, chatSettings.MinImageQuality, selfRepostFilter(chatSettings, message))
+	}
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return hash, fmt.Errorf("unable to get first matching sticker message: %w", err)
+	}
+	if err != nil && errors.Is(err, &ErrNotFound{}) || origMessage.MessageID == message.MessageID {
+		return hash, nil
+	}
+
+	err = r.reportRepost(ctx, storage, message, hash.matchKind(), hash.fingerprint(), origMessage)
+	if err != nil {
+		return hash, fmt.Errorf("unable to report repost: %w", err)
+	}
+
+	return hash, nil
+}
+
+func (r *UpdateHandler) getTelegramStickerHash(ctx context.Context, sticker *tg.Sticker) (*mediaHash, error) {
+	img, err := r.getTelegramImage(ctx, sticker.FileID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get telegram sticker: %w", err)
+	}
+
+	return getImageHash(img)
+}
+
+func (r *UpdateHandler) getTelegramVideoStickerHash(ctx context.Context, sticker *tg.Sticker) (*mediaHash, error) {
+	tempDir, err := fsutils.GetTempDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get temp dir: %w", err)
+	}
+	defer fsutils.CleanupTempDir(tempDir)
+
+	tempStickerPath := path.Join(tempDir, "sticker.webm")
+
+	err = r.getTelegramVideo(ctx, sticker.FileID, tempStickerPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get telegram sticker: %w", err)
+	}
+
+	hash, err := videohash.PerceptualVideoHash(ctx, tempStickerPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to calculate sticker perception hash: %w", err)
+	}
+
+	return &mediaHash{
+		VideoVideoHash: &hash.Video,
+		FrameSelection: string(hash.FrameSelection),
+		Quality:        &hash.Quality,
+	}, nil
+}
+
+func parseBoolArgument(arg string) (bool, error) {
+	switch strings.ToLower(strings.Trim(arg, " ")) {
+	case "on", "вкл":
+		return true, nil
+	case "off", "выкл":
+		return false, nil
+	default:
+		return strconv.ParseBool(strings.Trim(arg, " "))
+	}
+}
+
+func (r *UpdateHandler) handleChatSettingsStickerDetection(ctx context.Context, storage Storage, message *tg.Message) error {
+	enabled, err := parseBoolArgument(message.CommandArguments())
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть on или off")
+		if err != nil {
+			return fmt.Errorf("unable to send bool parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.StickerDetection = enabled
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
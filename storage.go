@@ -12,7 +12,7 @@ import (
 
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pressly/goose/v3"
 )
 
@@ -158,6 +158,58 @@ func int64PtrToUint64Ptr(v *int64) *uint64 {
 	return &res
 }
 
+func mediaTypeToDB(v MediaType) *string {
+	if v == "" {
+		return nil
+	}
+	return ptr(string(v))
+}
+
+func uint64sToDB(v []uint64) pq.Int64Array {
+	if v == nil {
+		return nil
+	}
+	res := make(pq.Int64Array, 0, len(v))
+	for _, x := range v {
+		res = append(res, int64(x))
+	}
+	return res
+}
+
+func uint64sFromDB(v pq.Int64Array) []uint64 {
+	if v == nil {
+		return nil
+	}
+	res := make([]uint64, 0, len(v))
+	for _, x := range v {
+		res = append(res, uint64(x))
+	}
+	return res
+}
+
+func emptyToNil(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return &v
+}
+
+// authorIDToDB is nil for messages sent on behalf of a chat
+func authorIDToDB(msg tgbotapi.Message) *int64 {
+	if msg.From == nil {
+		return nil
+	}
+	return &msg.From.ID
+}
+
+// authorFilterToDB is the author and the time since which their messages are left out, both nil when nothing is left out
+func authorFilterToDB(author *AuthorFilter) (*int64, *time.Time) {
+	if author == nil {
+		return nil, nil
+	}
+	return &author.AuthorID, &author.Since
+}
+
 func (r *storage) UpsertMessage(ctx context.Context, msg Message) error {
 	data, err := json.Marshal(msg.Raw)
 	if err != nil {
@@ -177,9 +229,17 @@ insert into message(
 	chat_id,
 	message_id,
 	data,
+	media_type,
 	image_hash,
 	video_video_hash,
 	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
+	author_id,
 	created_at,
 	updated_at
 ) values (
@@ -191,15 +251,31 @@ insert into message(
 	$6,
 	$7,
 	$8,
-	$9
+	$9,
+	$10,
+	$11,
+	$12,
+	$13,
+	$14,
+	$15,
+	$16,
+	$17
 )
 on conflict (chat_id, message_id)
 	do update 
 		set 
 			data = excluded.data,
+			media_type = excluded.media_type,
 			image_hash = excluded.image_hash, 
 			video_video_hash = excluded.video_video_hash, 
 			video_audio_hash = excluded.video_audio_hash, 
+			text_hash = excluded.text_hash,
+			urls = excluded.urls,
+			frame_selection = excluded.frame_selection,
+			quality = excluded.quality,
+			detail_hash = excluded.detail_hash,
+			hash_version = excluded.hash_version,
+			author_id = excluded.author_id,
 			updated_at = excluded.updated_at
 returning id
 	`,
@@ -207,9 +283,17 @@ returning id
 		msg.ChatID,
 		msg.MessageID,
 		string(data),
+		mediaTypeToDB(msg.MediaType),
 		uint64PtrToInt64Ptr(msg.ImageHash),
 		uint64PtrToInt64Ptr(msg.VideoVideoHash),
 		uint64PtrToInt64Ptr(msg.VideoAudioHash),
+		uint64PtrToInt64Ptr(msg.TextHash),
+		pq.StringArray(msg.URLs),
+		emptyToNil(msg.FrameSelection),
+		msg.Quality,
+		uint64sToDB(msg.DetailHash),
+		msg.HashVersion,
+		authorIDToDB(msg.Raw),
 		msg.CreatedAt,
 		msg.UpdatedAt,
 	)
@@ -229,14 +313,22 @@ returning id
 }
 
 type messageDB struct {
-	ChatID         int64     `db:"chat_id"`
-	MessageID      int       `db:"message_id"`
-	Raw            string    `db:"data"`
-	ImageHash      *int64    `db:"image_hash"`
-	VideoVideoHash *int64    `db:"video_video_hash"`
-	VideoAudioHash *int64    `db:"video_audio_hash"`
-	CreatedAt      time.Time `db:"created_at"`
-	UpdatedAt      time.Time `db:"updated_at"`
+	ChatID         int64          `db:"chat_id"`
+	MessageID      int            `db:"message_id"`
+	Raw            string         `db:"data"`
+	MediaType      *string        `db:"media_type"`
+	ImageHash      *int64         `db:"image_hash"`
+	VideoVideoHash *int64         `db:"video_video_hash"`
+	VideoAudioHash *int64         `db:"video_audio_hash"`
+	TextHash       *int64         `db:"text_hash"`
+	URLs           pq.StringArray `db:"urls"`
+	FrameSelection *string        `db:"frame_selection"`
+	Quality        *float64       `db:"quality"`
+	DetailHash     pq.Int64Array  `db:"detail_hash"`
+	HashVersion    *int           `db:"hash_version"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
+	DeletedAt      *time.Time     `db:"deleted_at"`
 }
 
 func messagesFromDB(r []messageDB) ([]Message, error) {
@@ -264,55 +356,95 @@ func messageFromDB(r messageDB) (*Message, error) {
 		ChatID:         r.ChatID,
 		MessageID:      r.MessageID,
 		Raw:            data,
+		MediaType:      MediaType(val(r.MediaType)),
 		ImageHash:      int64PtrToUint64Ptr(r.ImageHash),
 		VideoVideoHash: int64PtrToUint64Ptr(r.VideoVideoHash),
 		VideoAudioHash: int64PtrToUint64Ptr(r.VideoAudioHash),
+		TextHash:       int64PtrToUint64Ptr(r.TextHash),
+		URLs:           r.URLs,
+		FrameSelection: val(r.FrameSelection),
+		Quality:        r.Quality,
+		DetailHash:     uint64sFromDB(r.DetailHash),
+		HashVersion:    r.HashVersion,
 		CreatedAt:      r.CreatedAt,
 		UpdatedAt:      r.UpdatedAt,
+		DeletedAt:      r.DeletedAt,
 	}, nil
 }
 
-func (r *storage) getMatchingMessageByImageHash(ctx context.Context, chatID int64, hash uint64, hdist int, order string) (*Message, error) {
+func (r *storage) listMatchingMessagesByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int, minQuality float64, order string, limit int, author *AuthorFilter) ([]Message, error) {
 	var res []messageDB
 
+	authorID, authorSince := authorFilterToDB(author)
+
 	err := r.db.SelectContext(ctx, &res, `
 select 
 	chat_id,
 	message_id,
 	data,
+	media_type,
 	image_hash,
 	video_video_hash,
 	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
 	created_at,
 	updated_at
 from message
 where image_hash <@ ($1, $2)
 	and image_hash is not null
 	and chat_id = $3
-order by created_at `+order+` 
-limit 1
+	and media_type = $4
+	and hash_version = $5
+	and ($7::bigint is null or author_id is distinct from $7 or created_at < $8)
+	and (quality is null or quality >= $9)
+order by deleted_at is not null, created_at `+order+` 
+limit $6
 `,
 		int64(hash),
 		hdist,
 		chatID,
+		string(mediaType),
+		hashVersion,
+		limit,
+		authorID,
+		authorSince,
+		minQuality,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("unable to select message by image hash: %w", err)
 	}
 
+	return messagesFromDB(res)
+}
+
+func (r *storage) getMatchingMessageByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int, minQuality float64, order string, author *AuthorFilter) (*Message, error) {
+	res, err := r.listMatchingMessagesByImageHash(ctx, chatID, mediaType, hash, hdist, minQuality, order, 1, author)
+	if err != nil {
+		return nil, err
+	}
+
 	if len(res) == 0 {
 		return nil, &ErrNotFound{}
 	}
 
-	return messageFromDB(res[0])
+	return &res[0], nil
+}
+
+func (r *storage) ListMatchingMessagesByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int, minQuality float64, limit int, author *AuthorFilter) ([]Message, error) {
+	return r.listMatchingMessagesByImageHash(ctx, chatID, mediaType, hash, hdist, minQuality, "asc", limit, author)
 }
 
-func (r *storage) GetFirstMatchingMessageByImageHash(ctx context.Context, chatID int64, hash uint64, hdist int) (*Message, error) {
-	return r.getMatchingMessageByImageHash(ctx, chatID, hash, hdist, "asc")
+func (r *storage) GetFirstMatchingMessageByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int, minQuality float64, author *AuthorFilter) (*Message, error) {
+	return r.getMatchingMessageByImageHash(ctx, chatID, mediaType, hash, hdist, minQuality, "asc", author)
 }
 
-func (r *storage) GetLastMatchingMessageByImageHash(ctx context.Context, chatID int64, hash uint64, hdist int) (*Message, error) {
-	return r.getMatchingMessageByImageHash(ctx, chatID, hash, hdist, "desc")
+func (r *storage) GetLastMatchingMessageByImageHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, hdist int) (*Message, error) {
+	return r.getMatchingMessageByImageHash(ctx, chatID, mediaType, hash, hdist, 0, "desc", nil)
 }
 
 func (r *storage) GetMessage(ctx context.Context, chatID int64, messageID int) (*Message, error) {
@@ -323,11 +455,19 @@ select
 	chat_id,
 	message_id,
 	data,
+	media_type,
 	image_hash,
 	video_video_hash,
 	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
 	created_at,
-	updated_at
+	updated_at,
+	deleted_at
 from message
 where chat_id = $1
 	and message_id = $2
@@ -346,60 +486,158 @@ where chat_id = $1
 	return messageFromDB(res[0])
 }
 
-func (r *storage) SetLastUpdateID(ctx context.Context, lastUpdateID int) error {
+func (r *storage) ListMediaGroupMessages(ctx context.Context, chatID int64, mediaGroupID string) ([]Message, error) {
+	var res []messageDB
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	data,
+	media_type,
+	image_hash,
+	video_video_hash,
+	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
+	created_at,
+	updated_at
+from message
+where chat_id = $1
+	and data->>'media_group_id' = $2
+	and (image_hash is not null
+		or video_video_hash is not null)
+order by message_id
+`,
+		chatID,
+		mediaGroupID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select media group messages: %w", err)
+	}
+
+	return messagesFromDB(res)
+}
+
+func (r *storage) ReplaceMessageFrames(ctx context.Context, chatID int64, messageID int, frames []uint64) error {
 	_, err := r.db.ExecContext(ctx, `
-update last_update_id
-set last_update_id = $1
+delete from message_frame
+where chat_id = $1
+	and message_id = $2
 	`,
-		lastUpdateID,
+		chatID,
+		messageID,
 	)
 	if err != nil {
-		return fmt.Errorf("unable to udpate last_update_id: %w", err)
+		return fmt.Errorf("unable to delete message frames: %w", err)
+	}
+
+	for i, frame := range frames {
+		_, err := r.db.ExecContext(ctx, `
+insert into message_frame(
+	chat_id,
+	message_id,
+	frame_index,
+	hash,
+	hash_version
+) values (
+	$1,
+	$2,
+	$3,
+	$4,
+	$5
+)
+	`,
+			chatID,
+			messageID,
+			i,
+			int64(frame),
+			hashVersion,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to insert message frame: %w", err)
+		}
 	}
 
 	return nil
 }
 
-func (r *storage) GetLastUpdateID(ctx context.Context) (int, error) {
-	var res int
+func (r *storage) ListMessageFrames(ctx context.Context, chatID int64, messageID int) ([]uint64, error) {
+	var res []int64
 
-	err := r.db.GetContext(ctx, &res, `select last_update_id from last_update_id`)
+	err := r.db.SelectContext(ctx, &res, `
+select hash
+from message_frame
+where chat_id = $1
+	and message_id = $2
+	and hash_version = $3
+order by frame_index
+`,
+		chatID,
+		messageID,
+		hashVersion,
+	)
 	if err != nil {
-		return 0, fmt.Errorf("unable to select last_update_id: %w", err)
+		return nil, fmt.Errorf("unable to select message frames: %w", err)
 	}
 
-	return res, nil
+	frames := make([]uint64, 0, len(res))
+	for _, h := range res {
+		frames = append(frames, uint64(h))
+	}
+
+	return frames, nil
 }
 
-func (r *storage) getMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash uint64, audioHash uint64, hdist int, order string) (*Message, error) {
+// GetFirstMatchingMessageByFrameHash finds the first video or animation with a frame similar to the image
+func (r *storage) GetFirstMatchingMessageByFrameHash(ctx context.Context, chatID int64, hash uint64, hdist int, minQuality float64, author *AuthorFilter) (*Message, error) {
 	var res []messageDB
 
+	authorID, authorSince := authorFilterToDB(author)
+
 	err := r.db.SelectContext(ctx, &res, `
 select 
-	chat_id,
-	message_id,
-	data,
-	image_hash,
-	video_video_hash,
-	video_audio_hash,
-	created_at,
-	updated_at
-from message
-where video_video_hash <@ ($1, $3)
-	and video_video_hash is not null
-	and video_audio_hash <@ ($2, $3)
-	and video_audio_hash is not null
-	and chat_id = $4
-order by created_at `+order+` 
+	m.chat_id,
+	m.message_id,
+	m.data,
+	m.media_type,
+	m.image_hash,
+	m.video_video_hash,
+	m.video_audio_hash,
+	m.text_hash,
+	m.urls,
+	m.frame_selection,
+	m.quality,
+	m.detail_hash,
+	m.hash_version,
+	m.created_at,
+	m.updated_at
+from message_frame as f
+inner join message as m
+	on m.chat_id = f.chat_id
+		and m.message_id = f.message_id
+where f.hash <@ ($1, $2)
+	and f.chat_id = $3
+	and f.hash_version = $4
+	and ($5::bigint is null or m.author_id is distinct from $5 or m.created_at < $6)
+	and (m.quality is null or m.quality >= $7)
+order by m.deleted_at is not null, m.created_at asc
 limit 1
 `,
-		int64(videoHash),
-		int64(audioHash),
+		int64(hash),
 		hdist,
 		chatID,
+		hashVersion,
+		authorID,
+		authorSince,
+		minQuality,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to select message by image hash: %w", err)
+		return nil, fmt.Errorf("unable to select message by frame hash: %w", err)
 	}
 
 	if len(res) == 0 {
@@ -409,334 +647,1676 @@ limit 1
 	return messageFromDB(res[0])
 }
 
-func (r *storage) GetFirstMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, hdist int) (*Message, error) {
-	return r.getMatchingMessageByVideoHash(ctx, chatID, videoHash, audioHash, hdist, "asc")
-}
-
-func (r *storage) GetLastMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, hdist int) (*Message, error) {
-	return r.getMatchingMessageByVideoHash(ctx, chatID, videoHash, audioHash, hdist, "desc")
-}
-
-func (r *storage) CreateTopkek(ctx context.Context, tk Topkek) (int64, error) {
-	var id int64
-
-	err := r.db.GetContext(ctx, &id, `
-insert into topkek(
-	name,
-	chat_id,
-	message_id,
-	author_id,
-	created_at,
-	status
-) values (
-	$1,
-	$2,
-	$3,
-	$4,
-	$5,
-	$6
-)
-returning id
+func (r *storage) UpdateMessageHashes(ctx context.Context, msg Message) error {
+	_, err := r.db.ExecContext(ctx, `
+update message
+set image_hash = $3,
+	video_video_hash = $4,
+	video_audio_hash = $5,
+	frame_selection = $6,
+	quality = $7,
+	detail_hash = $8,
+	hash_version = $9,
+	updated_at = $10
+where chat_id = $1
+	and message_id = $2
 	`,
-		tk.Name,
-		tk.ChatID,
-		tk.MessageID,
-		tk.AuthorID,
-		tk.CreatedAt,
-		tk.Status,
+		msg.ChatID,
+		msg.MessageID,
+		uint64PtrToInt64Ptr(msg.ImageHash),
+		uint64PtrToInt64Ptr(msg.VideoVideoHash),
+		uint64PtrToInt64Ptr(msg.VideoAudioHash),
+		emptyToNil(msg.FrameSelection),
+		msg.Quality,
+		uint64sToDB(msg.DetailHash),
+		msg.HashVersion,
+		msg.UpdatedAt,
 	)
 	if err != nil {
-		return 0, fmt.Errorf("unable to insert topkek: %w", err)
+		return fmt.Errorf("unable to update message hashes: %w", err)
 	}
 
-	return id, nil
+	return nil
 }
 
-func (r *storage) UpdateTopkekStatus(ctx context.Context, id int64, status TopkekStatus) error {
-	_, err := r.db.ExecContext(ctx, `
-update topkek 
-set status = $2
-where id = $1
-	`,
-		id,
-		status,
+func (r *storage) CountMessagesToRehash(ctx context.Context, hashVersion int) (int, error) {
+	var res int
+
+	err := r.db.GetContext(ctx, &res, `
+select count(*)
+from message
+where (image_hash is not null
+		or video_video_hash is not null)
+	and hash_version is distinct from $1
+`,
+		hashVersion,
 	)
 	if err != nil {
-		return fmt.Errorf("unable to update topkek status: %w", err)
+		return 0, fmt.Errorf("unable to count messages to rehash: %w", err)
 	}
 
-	return nil
+	return res, nil
 }
 
-func (r *storage) GetLastTopkek(ctx context.Context, chatID int64) (*Topkek, error) {
-	var res []Topkek
+func (r *storage) ListMessagesToRehash(ctx context.Context, hashVersion int, after *RehashCursor, limit int) ([]Message, error) {
+	var res []messageDB
+
+	var afterChatID *int64
+	var afterMessageID *int
+	if after != nil {
+		afterChatID, afterMessageID = &after.ChatID, &after.MessageID
+	}
 
 	err := r.db.SelectContext(ctx, &res, `
 select 
-	id,
-	name,
 	chat_id,
 	message_id,
-	author_id,
+	data,
+	media_type,
+	image_hash,
+	video_video_hash,
+	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
 	created_at,
-	status
-from topkek
-where chat_id = $1
-order by id desc
-limit 1
+	updated_at
+from message
+where (image_hash is not null
+		or video_video_hash is not null)
+	and hash_version is distinct from $1
+	and ($2::bigint is null
+		or (chat_id, message_id) > ($2::bigint, $3::bigint))
+order by chat_id, message_id
+limit $4
 `,
-		chatID,
+		hashVersion,
+		afterChatID,
+		afterMessageID,
+		limit,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to select topkek: %w", err)
+		return nil, fmt.Errorf("unable to select messages to rehash: %w", err)
 	}
 
-	if len(res) == 0 {
-		return nil, &ErrNotFound{}
-	}
+	return messagesFromDB(res)
+}
 
-	return &res[0], nil
+type rehashJobDB struct {
+	HashVersion   int        `db:"hash_version"`
+	LastChatID    *int64     `db:"last_chat_id"`
+	LastMessageID *int       `db:"last_message_id"`
+	Total         int        `db:"total"`
+	Processed     int        `db:"processed"`
+	Skipped       int        `db:"skipped"`
+	Failed        int        `db:"failed"`
+	StartedAt     time.Time  `db:"started_at"`
+	UpdatedAt     time.Time  `db:"updated_at"`
+	FinishedAt    *time.Time `db:"finished_at"`
 }
 
-func (r *storage) GetTopkek(ctx context.Context, topkekID int64) (*Topkek, error) {
-	var res []Topkek
+func (r *storage) GetRehashJob(ctx context.Context, hashVersion int) (*RehashJob, error) {
+	var res []rehashJobDB
 
 	err := r.db.SelectContext(ctx, &res, `
 select 
-	id,
-	name,
-	chat_id,
-	message_id,
-	author_id,
-	created_at,
-	status
-from topkek
-where id = $1
+	hash_version,
+	last_chat_id,
+	last_message_id,
+	total,
+	processed,
+	skipped,
+	failed,
+	started_at,
+	updated_at,
+	finished_at
+from rehash_job
+where hash_version = $1
 `,
-		topkekID,
+		hashVersion,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to select topkek: %w", err)
+		return nil, fmt.Errorf("unable to select rehash job: %w", err)
 	}
 
 	if len(res) == 0 {
 		return nil, &ErrNotFound{}
 	}
 
-	return &res[0], nil
+	job := &RehashJob{
+		HashVersion: res[0].HashVersion,
+		Total:       res[0].Total,
+		Processed:   res[0].Processed,
+		Skipped:     res[0].Skipped,
+		Failed:      res[0].Failed,
+		StartedAt:   res[0].StartedAt,
+		UpdatedAt:   res[0].UpdatedAt,
+		FinishedAt:  res[0].FinishedAt,
+	}
+	if res[0].LastChatID != nil && res[0].LastMessageID != nil {
+		job.Cursor = &RehashCursor{
+			ChatID:    *res[0].LastChatID,
+			MessageID: *res[0].LastMessageID,
+		}
+	}
+
+	return job, nil
 }
 
-func (r *storage) CreateTopkekMessage(ctx context.Context, msg TopkekMessage) error {
-	raw, err := json.Marshal(msg.Raw)
-	if err != nil {
-		return fmt.Errorf("unable to marshal raw msg: %w", err)
+func (r *storage) UpsertRehashJob(ctx context.Context, job RehashJob) error {
+	var lastChatID *int64
+	var lastMessageID *int
+	if job.Cursor != nil {
+		lastChatID, lastMessageID = &job.Cursor.ChatID, &job.Cursor.MessageID
 	}
 
-	var id int64
-
-	err = r.db.GetContext(ctx, &id, `
-insert into topkek_message(
-	topkek_id,
-	chat_id,
-	message_id,
-	source_message_id,
-	type,
-	raw
+	_, err := r.db.ExecContext(ctx, `
+insert into rehash_job(
+	hash_version,
+	last_chat_id,
+	last_message_id,
+	total,
+	processed,
+	skipped,
+	failed,
+	started_at,
+	updated_at,
+	finished_at
 ) values (
 	$1,
 	$2,
 	$3,
 	$4,
 	$5,
-	$6
+	$6,
+	$7,
+	$8,
+	$9,
+	$10
 )
-returning id
+on conflict (hash_version)
+	do update 
+		set 
+			last_chat_id = excluded.last_chat_id,
+			last_message_id = excluded.last_message_id,
+			total = excluded.total,
+			processed = excluded.processed,
+			skipped = excluded.skipped,
+			failed = excluded.failed,
+			updated_at = excluded.updated_at,
+			finished_at = excluded.finished_at
 	`,
-		msg.TopkekID,
-		msg.ChatID,
-		msg.MessageID,
+		job.HashVersion,
+		lastChatID,
+		lastMessageID,
+		job.Total,
+		job.Processed,
+		job.Skipped,
+		job.Failed,
+		job.StartedAt,
+		job.UpdatedAt,
+		job.FinishedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to upsert rehash job: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) SetLastUpdateID(ctx context.Context, lastUpdateID int) error {
+	_, err := r.db.ExecContext(ctx, `
+update last_update_id
+set last_update_id = $1
+	`,
+		lastUpdateID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to udpate last_update_id: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) GetLastUpdateID(ctx context.Context) (int, error) {
+	var res int
+
+	err := r.db.GetContext(ctx, &res, `select last_update_id from last_update_id`)
+	if err != nil {
+		return 0, fmt.Errorf("unable to select last_update_id: %w", err)
+	}
+
+	return res, nil
+}
+
+func (r *storage) getMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash uint64, audioHash uint64, frameSelection string, hdist int, minQuality float64, order string, author *AuthorFilter) (*Message, error) {
+	var res []messageDB
+
+	authorID, authorSince := authorFilterToDB(author)
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	data,
+	media_type,
+	image_hash,
+	video_video_hash,
+	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
+	created_at,
+	updated_at
+from message
+where video_video_hash <@ ($1, $3)
+	and video_video_hash is not null
+	and video_audio_hash <@ ($2, $3)
+	and video_audio_hash is not null
+	and media_type = 'video'
+	and chat_id = $4
+	and frame_selection = $5
+	and hash_version = $6
+	and ($7::bigint is null or author_id is distinct from $7 or created_at < $8)
+	and (quality is null or quality >= $9)
+order by deleted_at is not null, created_at `+order+` 
+limit 1
+`,
+		int64(videoHash),
+		int64(audioHash),
+		hdist,
+		chatID,
+		frameSelection,
+		hashVersion,
+		authorID,
+		authorSince,
+		minQuality,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select message by image hash: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return messageFromDB(res[0])
+}
+
+func (r *storage) GetFirstMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, frameSelection string, hdist int, minQuality float64, author *AuthorFilter) (*Message, error) {
+	return r.getMatchingMessageByVideoHash(ctx, chatID, videoHash, audioHash, frameSelection, hdist, minQuality, "asc", author)
+}
+
+func (r *storage) GetLastMatchingMessageByVideoHash(ctx context.Context, chatID int64, videoHash, audioHash uint64, frameSelection string, hdist int) (*Message, error) {
+	return r.getMatchingMessageByVideoHash(ctx, chatID, videoHash, audioHash, frameSelection, hdist, 0, "desc", nil)
+}
+
+func (r *storage) getMatchingMessageByFramesHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, frameSelection string, hdist int, minQuality float64, order string, author *AuthorFilter) (*Message, error) {
+	var res []messageDB
+
+	authorID, authorSince := authorFilterToDB(author)
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	data,
+	media_type,
+	image_hash,
+	video_video_hash,
+	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
+	created_at,
+	updated_at
+from message
+where video_video_hash <@ ($1, $2)
+	and video_video_hash is not null
+	and media_type = $4
+	and chat_id = $3
+	and frame_selection = $5
+	and hash_version = $6
+	and ($7::bigint is null or author_id is distinct from $7 or created_at < $8)
+	and (quality is null or quality >= $9)
+order by deleted_at is not null, created_at `+order+` 
+limit 1
+`,
+		int64(hash),
+		hdist,
+		chatID,
+		string(mediaType),
+		frameSelection,
+		hashVersion,
+		authorID,
+		authorSince,
+		minQuality,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select message by frames hash: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return messageFromDB(res[0])
+}
+
+func (r *storage) GetFirstMatchingMessageByFramesHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, frameSelection string, hdist int, minQuality float64, author *AuthorFilter) (*Message, error) {
+	return r.getMatchingMessageByFramesHash(ctx, chatID, mediaType, hash, frameSelection, hdist, minQuality, "asc", author)
+}
+
+func (r *storage) GetLastMatchingMessageByFramesHash(ctx context.Context, chatID int64, mediaType MediaType, hash uint64, frameSelection string, hdist int) (*Message, error) {
+	return r.getMatchingMessageByFramesHash(ctx, chatID, mediaType, hash, frameSelection, hdist, 0, "desc", nil)
+}
+
+// GetFirstMatchingStickerMessage matches stickers by file_unique_id, animated (tgs) stickers have no hash
+// and are also matched by the set name and emoji among other animated stickers
+func (r *storage) GetFirstMatchingStickerMessage(ctx context.Context, chatID int64, sticker tgbotapi.Sticker, author *AuthorFilter) (*Message, error) {
+	var res []messageDB
+
+	authorID, authorSince := authorFilterToDB(author)
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	data,
+	media_type,
+	image_hash,
+	video_video_hash,
+	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
+	created_at,
+	updated_at
+from message
+where chat_id = $1
+	and media_type = 'sticker'
+	and (data->'sticker'->>'file_unique_id' = $2
+		or ($7
+			and $3 <> ''
+			and data->'sticker'->>'is_animated' = 'true'
+			and data->'sticker'->>'set_name' = $3
+			and data->'sticker'->>'emoji' = $4))
+	and ($5::bigint is null or author_id is distinct from $5 or created_at < $6)
+order by deleted_at is not null, created_at asc
+limit 1
+`,
+		chatID,
+		sticker.FileUniqueID,
+		sticker.SetName,
+		sticker.Emoji,
+		authorID,
+		authorSince,
+		sticker.IsAnimated,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select message by sticker: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return messageFromDB(res[0])
+}
+
+func (r *storage) getMatchingMessageByTextHash(ctx context.Context, chatID int64, hash uint64, hdist int, order string, author *AuthorFilter) (*Message, error) {
+	var res []messageDB
+
+	authorID, authorSince := authorFilterToDB(author)
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	data,
+	media_type,
+	image_hash,
+	video_video_hash,
+	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
+	created_at,
+	updated_at
+from message
+where text_hash <@ ($1, $2)
+	and text_hash is not null
+	and chat_id = $3
+	and ($4::bigint is null or author_id is distinct from $4 or created_at < $5)
+order by deleted_at is not null, created_at `+order+` 
+limit 1
+`,
+		int64(hash),
+		hdist,
+		chatID,
+		authorID,
+		authorSince,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select message by text hash: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return messageFromDB(res[0])
+}
+
+func (r *storage) GetFirstMatchingMessageByTextHash(ctx context.Context, chatID int64, hash uint64, hdist int, author *AuthorFilter) (*Message, error) {
+	return r.getMatchingMessageByTextHash(ctx, chatID, hash, hdist, "asc", author)
+}
+
+func (r *storage) GetLastMatchingMessageByTextHash(ctx context.Context, chatID int64, hash uint64, hdist int) (*Message, error) {
+	return r.getMatchingMessageByTextHash(ctx, chatID, hash, hdist, "desc", nil)
+}
+
+func (r *storage) GetFirstMatchingMessageByURLs(ctx context.Context, chatID int64, urls []string, author *AuthorFilter) (*Message, error) {
+	var res []messageDB
+
+	authorID, authorSince := authorFilterToDB(author)
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	data,
+	media_type,
+	image_hash,
+	video_video_hash,
+	video_audio_hash,
+	text_hash,
+	urls,
+	frame_selection,
+	quality,
+	detail_hash,
+	hash_version,
+	created_at,
+	updated_at
+from message
+where urls && $1
+	and urls is not null
+	and chat_id = $2
+	and ($3::bigint is null or author_id is distinct from $3 or created_at < $4)
+order by deleted_at is not null, created_at asc
+limit 1
+`,
+		pq.StringArray(urls),
+		chatID,
+		authorID,
+		authorSince,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select message by urls: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return messageFromDB(res[0])
+}
+
+func (r *storage) CreateTopkek(ctx context.Context, tk Topkek) (int64, error) {
+	var id int64
+
+	err := r.db.GetContext(ctx, &id, `
+insert into topkek(
+	name,
+	chat_id,
+	message_id,
+	author_id,
+	created_at,
+	status
+) values (
+	$1,
+	$2,
+	$3,
+	$4,
+	$5,
+	$6
+)
+returning id
+	`,
+		tk.Name,
+		tk.ChatID,
+		tk.MessageID,
+		tk.AuthorID,
+		tk.CreatedAt,
+		tk.Status,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("unable to insert topkek: %w", err)
+	}
+
+	return id, nil
+}
+
+func (r *storage) UpdateTopkekStatus(ctx context.Context, id int64, status TopkekStatus) error {
+	_, err := r.db.ExecContext(ctx, `
+update topkek 
+set status = $2
+where id = $1
+	`,
+		id,
+		status,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to update topkek status: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) GetLastTopkek(ctx context.Context, chatID int64) (*Topkek, error) {
+	var res []Topkek
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	id,
+	name,
+	chat_id,
+	message_id,
+	author_id,
+	created_at,
+	status
+from topkek
+where chat_id = $1
+order by id desc
+limit 1
+`,
+		chatID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select topkek: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return &res[0], nil
+}
+
+func (r *storage) GetTopkek(ctx context.Context, topkekID int64) (*Topkek, error) {
+	var res []Topkek
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	id,
+	name,
+	chat_id,
+	message_id,
+	author_id,
+	created_at,
+	status
+from topkek
+where id = $1
+`,
+		topkekID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select topkek: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return &res[0], nil
+}
+
+func (r *storage) CreateTopkekMessage(ctx context.Context, msg TopkekMessage) error {
+	raw, err := json.Marshal(msg.Raw)
+	if err != nil {
+		return fmt.Errorf("unable to marshal raw msg: %w", err)
+	}
+
+	var id int64
+
+	err = r.db.GetContext(ctx, &id, `
+insert into topkek_message(
+	topkek_id,
+	chat_id,
+	message_id,
+	source_message_id,
+	type,
+	raw
+) values (
+	$1,
+	$2,
+	$3,
+	$4,
+	$5,
+	$6
+)
+returning id
+	`,
+		msg.TopkekID,
+		msg.ChatID,
+		msg.MessageID,
 		msg.SourceMessageID,
 		string(msg.Type),
 		string(raw),
 	)
 	if err != nil {
-		return fmt.Errorf("unable to insert topkek message: %w", err)
+		return fmt.Errorf("unable to insert topkek message: %w", err)
+	}
+
+	return nil
+}
+
+type topkekMessageDB struct {
+	TopkekID        int64  `db:"topkek_id"`
+	ChatID          int64  `db:"chat_id"`
+	MessageID       int    `db:"message_id"`
+	SourceMessageID int    `db:"source_message_id"`
+	Type            string `db:"type"`
+	Raw             string `db:"raw"`
+}
+
+func topkekMessageFromDB(r topkekMessageDB) (*TopkekMessage, error) {
+	var data tgbotapi.Message
+	err := json.Unmarshal([]byte(r.Raw), &data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal raw msg: %w", err)
+	}
+
+	return &TopkekMessage{
+		TopkekID:        r.TopkekID,
+		ChatID:          r.ChatID,
+		MessageID:       r.MessageID,
+		SourceMessageID: r.SourceMessageID,
+		Type:            TopkekMessageType(r.Type),
+		Raw:             data,
+	}, nil
+}
+
+func topkekMessagesFromDB(r []topkekMessageDB) ([]TopkekMessage, error) {
+	res := make([]TopkekMessage, 0, len(r))
+
+	for _, msg := range r {
+		rr, err := topkekMessageFromDB(msg)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, *rr)
+	}
+
+	return res, nil
+}
+
+func (r *storage) GetTopkekMessages(ctx context.Context, topkekID int64) ([]TopkekMessage, error) {
+	var res []topkekMessageDB
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	topkek_id,
+	chat_id,
+	message_id,
+	source_message_id,
+	type,
+	raw
+from topkek_message
+where topkek_id = $1
+order by id
+`,
+		topkekID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select topkek messages: %w", err)
+	}
+
+	return topkekMessagesFromDB(res)
+}
+
+func (r *storage) DeleteTopkekMessages(ctx context.Context, topkekID int64) error {
+	_, err := r.db.ExecContext(ctx, `
+delete from topkek_message
+where topkek_id = $1
+`,
+		topkekID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to select topkek messages: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) UpsertMessageReactions(ctx context.Context, msg MessageReactions) error {
+	reactions, err := json.Marshal(msg.Reactions)
+	if err != nil {
+		return fmt.Errorf("unable to marshal reactions: %w", err)
+	}
+
+	_, err = r.db.ExecContext(ctx, `
+insert into message_reactions(
+	chat_id,
+	message_id,
+	user_id,
+	reactions,
+	created_at,
+	updated_at
+) values (
+	$1,
+	$2,
+	$3,
+	$4,
+	$5,
+	$6
+)
+on conflict (chat_id, message_id, user_id)
+	do update 
+		set 
+			reactions = excluded.reactions,
+			updated_at = excluded.updated_at
+	`,
+		msg.ChatID,
+		msg.MessageID,
+		msg.UserID,
+		string(reactions),
+		msg.CreatedAt,
+		msg.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to upsert message reactions: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) ListMessagesWithReactionCount(ctx context.Context, opts ListMessagesWithReactionCountOptions) ([]Message, error) {
+	var res []messageDB
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	m.chat_id,
+	m.message_id,
+	m.data,
+	m.media_type,
+	m.image_hash,
+	m.video_video_hash,
+	m.video_audio_hash,
+	m.text_hash,
+	m.urls,
+	m.frame_selection,
+	m.quality,
+	m.detail_hash,
+	m.hash_version,
+	m.created_at,
+	m.updated_at
+from message as m
+inner join lateral (
+	SELECT chat_id, message_id, 
+		sum(coalesce(jsonb_array_length(reactions), 0)) reacts, 
+      	sum(
+           coalesce((SELECT sum((case 
+							when (elem->>'emoji') IN ($1, $2) 
+								then 1
+							else 0
+					end))
+           FROM jsonb_array_elements(reactions) AS elem
+		   group by chat_id, message_id), 0)
+       	) AS is_stale
+	FROM message_reactions as mr
+	where mr.chat_id = m.chat_id
+		and mr.message_id = m.message_id
+	group by mr.chat_id, mr.message_id
+) as mr
+	on mr.is_stale = 0
+		and mr.reacts >= $3
+where m.chat_id = $4
+	and m.id >= (select id from message where chat_id = $4 and message_id = $5)
+	and (m.image_hash is not null
+		or (m.video_video_hash is not null
+			and m.video_audio_hash is not null)
+		or (m.video_video_hash is not null
+			and m.media_type = 'animation'))
+	and m.media_type <> 'sticker'
+	-- telegram does not mix documents with photos and videos in a media group,
+	-- so memes sent as files are matched as reposts but never enter topkek
+	and (m.data->'document' is null
+		or m.data->'animation' is not null)
+	and not exists (
+		select 1
+		from meme_cluster as c
+		inner join meme_cluster as e
+			on e.chat_id = c.chat_id
+				and e.cluster_id = c.cluster_id
+				and e.message_id < c.message_id
+		where c.chat_id = m.chat_id
+			and c.message_id = m.message_id
+	)
+order by m.id
+`,
+		opts.ExcludeReactions[0],
+		opts.ExcludeReactions[1],
+		opts.MinReactions,
+		opts.ChatID,
+		opts.StartingMessageID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select message with min reactions: %w", err)
+	}
+
+	return messagesFromDB(res)
+}
+
+func (r *storage) UpsertTemplateRelation(ctx context.Context, relation TemplateRelation) error {
+	_, err := r.db.ExecContext(ctx, `
+insert into meme_template(
+	chat_id,
+	message_id,
+	template_message_id,
+	image_distance,
+	detail_distance,
+	created_at
+) values (
+	$1,
+	$2,
+	$3,
+	$4,
+	$5,
+	$6
+)
+on conflict (chat_id, message_id)
+	do update 
+		set 
+			template_message_id = excluded.template_message_id,
+			image_distance = excluded.image_distance,
+			detail_distance = excluded.detail_distance
+	`,
+		relation.ChatID,
+		relation.MessageID,
+		relation.TemplateMessageID,
+		relation.ImageDistance,
+		relation.DetailDistance,
+		relation.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to upsert template relation: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) GetTemplateRelation(ctx context.Context, chatID int64, messageID int) (*TemplateRelation, error) {
+	var res []TemplateRelation
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	template_message_id,
+	image_distance,
+	detail_distance,
+	created_at
+from meme_template
+where chat_id = $1
+	and message_id = $2
+`,
+		chatID,
+		messageID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select template relation: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return &res[0], nil
+}
+
+func (r *storage) ListTopTemplates(ctx context.Context, chatID int64, limit int) ([]TemplateStats, error) {
+	var res []TemplateStats
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	template_message_id,
+	count(*) as uses,
+	max(created_at) as last_used_at
+from meme_template
+where chat_id = $1
+group by template_message_id
+order by uses desc, last_used_at desc
+limit $2
+`,
+		chatID,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select top templates: %w", err)
+	}
+
+	return res, nil
+}
+
+func (r *storage) GetMemeClusterID(ctx context.Context, chatID int64, messageID int) (int, error) {
+	var res []int
+
+	err := r.db.SelectContext(ctx, &res, `
+select cluster_id
+from meme_cluster
+where chat_id = $1
+	and message_id = $2
+`,
+		chatID,
+		messageID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("unable to select meme cluster id: %w", err)
+	}
+
+	if len(res) == 0 {
+		return 0, &ErrNotFound{}
+	}
+
+	return res[0], nil
+}
+
+func (r *storage) CreateMemeCluster(ctx context.Context, chatID int64, messageID int) error {
+	_, err := r.db.ExecContext(ctx, `
+insert into meme_cluster(
+	chat_id,
+	message_id,
+	cluster_id,
+	created_at
+) values (
+	$1,
+	$2,
+	$2,
+	$3
+)
+on conflict (chat_id, message_id)
+	do nothing
+	`,
+		chatID,
+		messageID,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to insert meme cluster: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) UpsertMemeClusterMember(ctx context.Context, member MemeClusterMember) error {
+	_, err := r.db.ExecContext(ctx, `
+insert into meme_cluster(
+	chat_id,
+	message_id,
+	cluster_id,
+	created_at
+) values (
+	$1,
+	$2,
+	$3,
+	$4
+)
+on conflict (chat_id, message_id)
+	do update 
+		set 
+			cluster_id = excluded.cluster_id
+	`,
+		member.ChatID,
+		member.MessageID,
+		member.ClusterID,
+		member.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to upsert meme cluster member: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) MergeMemeClusters(ctx context.Context, chatID int64, fromClusterID, toClusterID int) error {
+	_, err := r.db.ExecContext(ctx, `
+update meme_cluster
+set cluster_id = $3
+where chat_id = $1
+	and cluster_id = $2
+	`,
+		chatID,
+		fromClusterID,
+		toClusterID,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to merge meme clusters: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) GetMemeClusterOrigin(ctx context.Context, chatID int64, messageID int) (*Message, error) {
+	return r.getMemeClusterOrigin(ctx, chatID, messageID, false)
+}
+
+func (r *storage) GetMemeClusterSurvivingOrigin(ctx context.Context, chatID int64, messageID int) (*Message, error) {
+	return r.getMemeClusterOrigin(ctx, chatID, messageID, true)
+}
+
+func (r *storage) getMemeClusterOrigin(ctx context.Context, chatID int64, messageID int, surviving bool) (*Message, error) {
+	var res []messageDB
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	m.chat_id,
+	m.message_id,
+	m.data,
+	m.media_type,
+	m.image_hash,
+	m.video_video_hash,
+	m.video_audio_hash,
+	m.text_hash,
+	m.urls,
+	m.frame_selection,
+	m.quality,
+	m.detail_hash,
+	m.hash_version,
+	m.created_at,
+	m.updated_at,
+	m.deleted_at
+from meme_cluster as c
+inner join meme_cluster as o
+	on o.chat_id = c.chat_id
+		and o.cluster_id = c.cluster_id
+inner join message as m
+	on m.chat_id = o.chat_id
+		and m.message_id = o.message_id
+where c.chat_id = $1
+	and c.message_id = $2
+	and (not $3 or m.deleted_at is null)
+order by m.message_id asc
+limit 1
+`,
+		chatID,
+		messageID,
+		surviving,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select meme cluster origin: %w", err)
+	}
+
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
+	}
+
+	return messageFromDB(res[0])
+}
+
+// MarkMessageDeleted tombstones a message that is gone from the chat, it keeps counting for repost history
+// but is no longer replied to as the original
+func (r *storage) MarkMessageDeleted(ctx context.Context, chatID int64, messageID int, deletedAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+update message
+set deleted_at = $3
+where chat_id = $1
+	and message_id = $2
+	and deleted_at is null
+`,
+		chatID,
+		messageID,
+		deletedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to update message deleted at: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) ListMemeClusterMessages(ctx context.Context, chatID int64, clusterID int) ([]Message, error) {
+	var res []messageDB
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	m.chat_id,
+	m.message_id,
+	m.data,
+	m.media_type,
+	m.image_hash,
+	m.video_video_hash,
+	m.video_audio_hash,
+	m.text_hash,
+	m.urls,
+	m.frame_selection,
+	m.quality,
+	m.detail_hash,
+	m.hash_version,
+	m.created_at,
+	m.updated_at,
+	m.deleted_at
+from meme_cluster as c
+inner join message as m
+	on m.chat_id = c.chat_id
+		and m.message_id = c.message_id
+where c.chat_id = $1
+	and c.cluster_id = $2
+order by m.message_id asc
+`,
+		chatID,
+		clusterID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select meme cluster messages: %w", err)
+	}
+
+	return messagesFromDB(res)
+}
+
+func (r *storage) ListTopMemeClusters(ctx context.Context, chatID int64, limit int) ([]MemeClusterStats, error) {
+	var res []MemeClusterStats
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	cluster_id,
+	count(*) as size,
+	max(created_at) as last_seen_at
+from meme_cluster
+where chat_id = $1
+group by cluster_id
+having count(*) > 1
+order by size desc, last_seen_at desc
+limit $2
+`,
+		chatID,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select top meme clusters: %w", err)
+	}
+
+	return res, nil
+}
+
+type matchFeedbackDB struct {
+	ChatID            int64         `db:"chat_id"`
+	MessageID         int           `db:"message_id"`
+	OriginalMessageID int           `db:"original_message_id"`
+	Kind              *string       `db:"kind"`
+	Hash              pq.Int64Array `db:"hash"`
+	OriginalHash      pq.Int64Array `db:"original_hash"`
+	Distance          *int          `db:"distance"`
+	AuthorID          int64         `db:"author_id"`
+	CreatedAt         time.Time     `db:"created_at"`
+}
+
+func (r *storage) UpsertMatchFeedback(ctx context.Context, feedback MatchFeedback) error {
+	_, err := r.db.ExecContext(ctx, `
+insert into match_feedback(
+	chat_id,
+	message_id,
+	original_message_id,
+	kind,
+	hash,
+	original_hash,
+	distance,
+	author_id,
+	created_at
+) values (
+	$1,
+	$2,
+	$3,
+	$4,
+	$5,
+	$6,
+	$7,
+	$8,
+	$9
+)
+on conflict (chat_id, message_id, original_message_id)
+	do update 
+		set 
+			kind = excluded.kind,
+			hash = excluded.hash,
+			original_hash = excluded.original_hash,
+			distance = excluded.distance,
+			author_id = excluded.author_id
+	`,
+		feedback.ChatID,
+		feedback.MessageID,
+		feedback.OriginalMessageID,
+		(*string)(feedback.Kind),
+		uint64sToDB(feedback.Hash),
+		uint64sToDB(feedback.OriginalHash),
+		feedback.Distance,
+		feedback.AuthorID,
+		feedback.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to upsert match feedback: %w", err)
+	}
+
+	return nil
+}
+
+func (r *storage) ListOriginalMatchFeedback(ctx context.Context, chatID int64, originalMessageID int) ([]MatchFeedback, error) {
+	var res []matchFeedbackDB
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	original_message_id,
+	kind,
+	hash,
+	original_hash,
+	distance,
+	author_id,
+	created_at
+from match_feedback
+where chat_id = $1
+	and original_message_id = $2
+order by created_at asc
+`,
+		chatID,
+		originalMessageID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select original match feedback: %w", err)
 	}
 
-	return nil
+	return matchFeedbackFromDB(res), nil
 }
 
-type topkekMessageDB struct {
-	TopkekID        int64  `db:"topkek_id"`
-	ChatID          int64  `db:"chat_id"`
-	MessageID       int    `db:"message_id"`
-	SourceMessageID int    `db:"source_message_id"`
-	Type            string `db:"type"`
-	Raw             string `db:"raw"`
+func (r *storage) ListMatchFeedback(ctx context.Context, chatID int64) ([]MatchFeedback, error) {
+	var res []matchFeedbackDB
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
+	chat_id,
+	message_id,
+	original_message_id,
+	kind,
+	hash,
+	original_hash,
+	distance,
+	author_id,
+	created_at
+from match_feedback
+where chat_id = $1
+order by created_at asc
+`,
+		chatID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select match feedback: %w", err)
+	}
+
+	return matchFeedbackFromDB(res), nil
 }
 
-func topkekMessageFromDB(r topkekMessageDB) (*TopkekMessage, error) {
-	var data tgbotapi.Message
-	err := json.Unmarshal([]byte(r.Raw), &data)
+func matchFeedbackFromDB(res []matchFeedbackDB) []MatchFeedback {
+	feedback := make([]MatchFeedback, 0, len(res))
+	for _, f := range res {
+		feedback = append(feedback, MatchFeedback{
+			ChatID:            f.ChatID,
+			MessageID:         f.MessageID,
+			OriginalMessageID: f.OriginalMessageID,
+			Kind:              (*MatchKind)(f.Kind),
+			Hash:              uint64sFromDB(f.Hash),
+			OriginalHash:      uint64sFromDB(f.OriginalHash),
+			Distance:          f.Distance,
+			AuthorID:          f.AuthorID,
+			CreatedAt:         f.CreatedAt,
+		})
+	}
+
+	return feedback
+}
+
+func (r *storage) UpsertManualMatch(ctx context.Context, match ManualMatch) error {
+	_, err := r.db.ExecContext(ctx, `
+insert into manual_match(
+	chat_id,
+	message_id,
+	original_message_id,
+	author_id,
+	created_at
+) values (
+	$1,
+	$2,
+	$3,
+	$4,
+	$5
+)
+on conflict (chat_id, message_id)
+	do update 
+		set 
+			original_message_id = excluded.original_message_id,
+			author_id = excluded.author_id,
+			created_at = excluded.created_at,
+			revoked_by = null,
+			revoked_at = null
+	`,
+		match.ChatID,
+		match.MessageID,
+		match.OriginalMessageID,
+		match.AuthorID,
+		match.CreatedAt,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal raw msg: %w", err)
+		return fmt.Errorf("unable to upsert manual match: %w", err)
 	}
 
-	return &TopkekMessage{
-		TopkekID:        r.TopkekID,
-		ChatID:          r.ChatID,
-		MessageID:       r.MessageID,
-		SourceMessageID: r.SourceMessageID,
-		Type:            TopkekMessageType(r.Type),
-		Raw:             data,
-	}, nil
+	return nil
 }
 
-func topkekMessagesFromDB(r []topkekMessageDB) ([]TopkekMessage, error) {
-	res := make([]TopkekMessage, 0, len(r))
+func (r *storage) GetManualMatch(ctx context.Context, chatID int64, messageID int) (*ManualMatch, error) {
+	res, err := r.ListManualMatches(ctx, chatID, []int{messageID})
+	if err != nil {
+		return nil, err
+	}
 
-	for _, msg := range r {
-		rr, err := topkekMessageFromDB(msg)
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, *rr)
+	if len(res) == 0 {
+		return nil, &ErrNotFound{}
 	}
 
-	return res, nil
+	return &res[0], nil
 }
 
-func (r *storage) GetTopkekMessages(ctx context.Context, topkekID int64) ([]TopkekMessage, error) {
-	var res []topkekMessageDB
+func (r *storage) ListManualMatches(ctx context.Context, chatID int64, messageIDs []int) ([]ManualMatch, error) {
+	var res []ManualMatch
+
+	ids := make(pq.Int64Array, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		ids = append(ids, int64(id))
+	}
 
 	err := r.db.SelectContext(ctx, &res, `
 select 
-	topkek_id,
 	chat_id,
 	message_id,
-	source_message_id,
-	type,
-	raw
-from topkek_message
-where topkek_id = $1
-order by id
+	original_message_id,
+	author_id,
+	created_at,
+	revoked_by,
+	revoked_at
+from manual_match
+where chat_id = $1
+	and message_id = any($2)
+	and revoked_at is null
+order by message_id asc
 `,
-		topkekID,
+		chatID,
+		ids,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to select topkek messages: %w", err)
+		return nil, fmt.Errorf("unable to select manual matches: %w", err)
 	}
 
-	return topkekMessagesFromDB(res)
+	return res, nil
 }
 
-func (r *storage) DeleteTopkekMessages(ctx context.Context, topkekID int64) error {
+func (r *storage) RevokeManualMatch(ctx context.Context, chatID int64, messageID int, revokedBy int64) error {
 	_, err := r.db.ExecContext(ctx, `
-delete from topkek_message
-where topkek_id = $1
-`,
-		topkekID,
+update manual_match
+set revoked_by = $3,
+	revoked_at = $4
+where chat_id = $1
+	and message_id = $2
+	and revoked_at is null
+	`,
+		chatID,
+		messageID,
+		revokedBy,
+		time.Now().UTC(),
 	)
 	if err != nil {
-		return fmt.Errorf("unable to select topkek messages: %w", err)
+		return fmt.Errorf("unable to revoke manual match: %w", err)
 	}
 
 	return nil
 }
 
-func (r *storage) UpsertMessageReactions(ctx context.Context, msg MessageReactions) error {
-	reactions, err := json.Marshal(msg.Reactions)
+func (r *storage) UpsertAllowedMeme(ctx context.Context, meme AllowedMeme) error {
+	_, err := r.db.ExecContext(ctx, `
+insert into allowed_meme(
+	chat_id,
+	message_id,
+	author_id,
+	created_at
+) values (
+	$1,
+	$2,
+	$3,
+	$4
+)
+on conflict (chat_id, message_id)
+	do update 
+		set 
+			author_id = excluded.author_id,
+			created_at = excluded.created_at
+	`,
+		meme.ChatID,
+		meme.MessageID,
+		meme.AuthorID,
+		meme.CreatedAt,
+	)
 	if err != nil {
-		return fmt.Errorf("unable to marshal reactions: %w", err)
+		return fmt.Errorf("unable to upsert allowed meme: %w", err)
 	}
 
-	_, err = r.db.ExecContext(ctx, `
-insert into message_reactions(
+	return nil
+}
+
+func (r *storage) IsAllowedMeme(ctx context.Context, chatID int64, messageID int) (bool, error) {
+	var res bool
+
+	err := r.db.GetContext(ctx, &res, `
+select exists (
+	select 1
+	from meme_cluster as c
+	inner join meme_cluster as ac
+		on ac.chat_id = c.chat_id
+			and ac.cluster_id = c.cluster_id
+	inner join allowed_meme as a
+		on a.chat_id = ac.chat_id
+			and a.message_id = ac.message_id
+	where c.chat_id = $1
+		and c.message_id = $2
+)
+`,
+		chatID,
+		messageID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("unable to select allowed meme: %w", err)
+	}
+
+	return res, nil
+}
+
+func (r *storage) DeleteAllowedMemes(ctx context.Context, chatID int64, messageID int) (int, error) {
+	res, err := r.db.ExecContext(ctx, `
+delete from allowed_meme
+where chat_id = $1
+	and (message_id = $2
+		or message_id in (
+			select ac.message_id
+			from meme_cluster as c
+			inner join meme_cluster as ac
+				on ac.chat_id = c.chat_id
+					and ac.cluster_id = c.cluster_id
+			where c.chat_id = $1
+				and c.message_id = $2
+		))
+	`,
+		chatID,
+		messageID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("unable to delete allowed memes: %w", err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get deleted allowed memes count: %w", err)
+	}
+
+	return int(deleted), nil
+}
+
+func (r *storage) ListAllowedMemes(ctx context.Context, chatID int64) ([]AllowedMeme, error) {
+	var res []AllowedMeme
+
+	err := r.db.SelectContext(ctx, &res, `
+select 
 	chat_id,
 	message_id,
-	user_id,
-	reactions,
-	created_at,
-	updated_at
+	author_id,
+	created_at
+from allowed_meme
+where chat_id = $1
+order by created_at asc
+`,
+		chatID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to select allowed memes: %w", err)
+	}
+
+	return res, nil
+}
+
+type bannedMemeDB struct {
+	ID              int64         `db:"id"`
+	ChatID          int64         `db:"chat_id"`
+	Kind            string        `db:"kind"`
+	Hash            pq.Int64Array `db:"hash"`
+	HashVersion     int           `db:"hash_version"`
+	SourceMessageID *int          `db:"source_message_id"`
+	AuthorID        int64         `db:"author_id"`
+	CreatedAt       time.Time     `db:"created_at"`
+}
+
+// CreateBannedMeme is false when the hash is already banned
+func (r *storage) CreateBannedMeme(ctx context.Context, meme BannedMeme) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+insert into banned_meme(
+	chat_id,
+	kind,
+	hash,
+	hash_version,
+	source_message_id,
+	author_id,
+	created_at
 ) values (
 	$1,
 	$2,
 	$3,
 	$4,
 	$5,
-	$6
+	$6,
+	$7
 )
-on conflict (chat_id, message_id, user_id)
-	do update 
-		set 
-			reactions = excluded.reactions,
-			updated_at = excluded.updated_at
+on conflict (chat_id, kind, hash, hash_version)
+	do nothing
 	`,
-		msg.ChatID,
-		msg.MessageID,
-		msg.UserID,
-		string(reactions),
-		msg.CreatedAt,
-		msg.UpdatedAt,
+		meme.ChatID,
+		string(meme.Kind),
+		uint64sToDB(meme.Hash),
+		meme.HashVersion,
+		meme.SourceMessageID,
+		meme.AuthorID,
+		meme.CreatedAt,
 	)
 	if err != nil {
-		return fmt.Errorf("unable to upsert message reactions: %w", err)
+		return false, fmt.Errorf("unable to insert banned meme: %w", err)
 	}
 
-	return nil
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("unable to get inserted banned memes count: %w", err)
+	}
+
+	return inserted != 0, nil
 }
 
-func (r *storage) ListMessagesWithReactionCount(ctx context.Context, opts ListMessagesWithReactionCountOptions) ([]Message, error) {
-	var res []messageDB
+func (r *storage) ListBannedMemes(ctx context.Context, chatID int64) ([]BannedMeme, error) {
+	var res []bannedMemeDB
 
 	err := r.db.SelectContext(ctx, &res, `
 select 
-	m.chat_id,
-	m.message_id,
-	m.data,
-	m.image_hash,
-	m.video_video_hash,
-	m.video_audio_hash,
-	m.created_at,
-	m.updated_at
-from message as m
-inner join lateral (
-	SELECT chat_id, message_id, 
-		sum(coalesce(jsonb_array_length(reactions), 0)) reacts, 
-      	sum(
-           coalesce((SELECT sum((case 
-							when (elem->>'emoji') IN ($1, $2) 
-								then 1
-							else 0
-					end))
-           FROM jsonb_array_elements(reactions) AS elem
-		   group by chat_id, message_id), 0)
-       	) AS is_stale
-	FROM message_reactions as mr
-	where mr.chat_id = m.chat_id
-		and mr.message_id = m.message_id
-	group by mr.chat_id, mr.message_id
-) as mr
-	on mr.is_stale = 0
-		and mr.reacts >= $3
-where m.chat_id = $4
-	and m.id >= (select id from message where chat_id = $4 and message_id = $5)
-	and (m.image_hash is not null
-		or (m.video_video_hash is not null
-			and m.video_audio_hash is not null))
-order by m.id
+	id,
+	chat_id,
+	kind,
+	hash,
+	hash_version,
+	source_message_id,
+	author_id,
+	created_at
+from banned_meme
+where chat_id = $1
+order by id asc
 `,
-		opts.ExcludeReactions[0],
-		opts.ExcludeReactions[1],
-		opts.MinReactions,
-		opts.ChatID,
-		opts.StartingMessageID,
+		chatID,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to select message with min reactions: %w", err)
+		return nil, fmt.Errorf("unable to select banned memes: %w", err)
 	}
 
-	return messagesFromDB(res)
+	memes := make([]BannedMeme, 0, len(res))
+	for _, m := range res {
+		memes = append(memes, BannedMeme{
+			ID:              m.ID,
+			ChatID:          m.ChatID,
+			Kind:            MatchKind(m.Kind),
+			Hash:            uint64sFromDB(m.Hash),
+			HashVersion:     m.HashVersion,
+			SourceMessageID: m.SourceMessageID,
+			AuthorID:        m.AuthorID,
+			CreatedAt:       m.CreatedAt,
+		})
+	}
+
+	return memes, nil
+}
+
+func (r *storage) DeleteBannedMeme(ctx context.Context, chatID int64, id int64) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+delete from banned_meme
+where chat_id = $1
+	and id = $2
+	`,
+		chatID,
+		id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete banned meme: %w", err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("unable to get deleted banned memes count: %w", err)
+	}
+
+	return deleted != 0, nil
 }
 
 func (r *storage) UpsertChatSettings(ctx context.Context, settings ChatSettings) error {
@@ -745,24 +2325,64 @@ insert into chat_settings(
 	chat_id,
 	min_reactions,
 	image_hamming_distance,
-	video_hamming_distance
+	video_hamming_distance,
+	sticker_detection,
+	text_hamming_distance,
+	min_image_quality,
+	template_hamming_distance,
+	template_detail_distance,
+	ban_warning,
+	repeated_days,
+	forgiven_days,
+	self_repost_grace_minutes,
+	ignore_self_reposts
 ) values (
 	$1,
 	$2,
 	$3,
-	$4
+	$4,
+	$5,
+	$6,
+	$7,
+	$8,
+	$9,
+	$10,
+	$11,
+	$12,
+	$13,
+	$14
 )
 on conflict (chat_id)
 	do update 
 		set 
 			min_reactions = excluded.min_reactions,
 			image_hamming_distance = excluded.image_hamming_distance,
-			video_hamming_distance = excluded.video_hamming_distance
+			video_hamming_distance = excluded.video_hamming_distance,
+			sticker_detection = excluded.sticker_detection,
+			text_hamming_distance = excluded.text_hamming_distance,
+			min_image_quality = excluded.min_image_quality,
+			template_hamming_distance = excluded.template_hamming_distance,
+			template_detail_distance = excluded.template_detail_distance,
+			ban_warning = excluded.ban_warning,
+			repeated_days = excluded.repeated_days,
+			forgiven_days = excluded.forgiven_days,
+			self_repost_grace_minutes = excluded.self_repost_grace_minutes,
+			ignore_self_reposts = excluded.ignore_self_reposts
 	`,
 		settings.ChatID,
 		settings.MinReactions,
 		settings.ImageHammingDistance,
 		settings.VideoHammingDistance,
+		settings.StickerDetection,
+		settings.TextHammingDistance,
+		settings.MinImageQuality,
+		settings.TemplateHammingDistance,
+		settings.TemplateDetailDistance,
+		settings.BanWarning,
+		settings.RepeatedDays,
+		settings.ForgivenDays,
+		settings.SelfRepostGraceMinutes,
+		settings.IgnoreSelfReposts,
 	)
 	if err != nil {
 		return fmt.Errorf("unable to upsert chat settings: %w", err)
@@ -779,7 +2399,17 @@ select
 	chat_id,
 	min_reactions,
 	image_hamming_distance,
-	video_hamming_distance
+	video_hamming_distance,
+	sticker_detection,
+	text_hamming_distance,
+	min_image_quality,
+	template_hamming_distance,
+	template_detail_distance,
+	ban_warning,
+	repeated_days,
+	forgiven_days,
+	self_repost_grace_minutes,
+	ignore_self_reposts
 from chat_settings
 where chat_id = $1
 `,
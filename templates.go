@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+const (
+	// repostDetailMargin is how far beyond the template detail distance the details of a photo within the image distance
+	// have to be for it to be a template rather than a repost. Re-encoded copies are a few bits apart,
+	// a different text of a template is 10 and more bits apart, see /settmpldetail.
+	repostDetailMargin = 3
+	// imageCandidatesLimit is how many similar images are checked for details
+	imageCandidatesLimit = 50
+	topTemplatesLimit    = 10
+)
+
+// imageMatch is the first repost of an image or, when there is none, the first image of the same template
+type imageMatch struct {
+	Repost *Message
+	// Similar are all images and videos within the image distance with the same details, they belong to one meme cluster
+	Similar  []*Message
+	Template *Message
+	// ImageDistance and DetailDistance are distances to the template
+	ImageDistance  int
+	DetailDistance int
+}
+
+// origin returns the message the image is compared with and the /why reply about it
+func (m *imageMatch) origin() (*Message, string, error) {
+	switch {
+	case m.Repost != nil:
+		return m.Repost, ".", nil
+	case m.Template != nil:
+		return m.Template, "тот же шаблон, другой текст", nil
+	default:
+		return nil, "", &ErrNotFound{}
+	}
+}
+
+// detailDistance is false when either image was hashed before detail hashes were introduced
+func detailDistance(a, b []uint64) (int, bool) {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0, false
+	}
+
+	dist := 0
+	for i := range a {
+		dist += bits.OnesCount64(a[i] ^ b[i])
+	}
+
+	return dist, true
+}
+
+// findImageRepostOrTemplate looks for the first photo within the image distance with the same details
+// or the first video with a similar frame, then for the first photo within the template distance with different details.
+// Photos within the image distance are reposts unless their details are clearly beyond the template detail distance.
+// Photos hashed without details are matched by the image distance only. Messages left out by the author filter
+// are not reposts, but may still share a template. Other messages of the same album are never matched.
+func findImageRepostOrTemplate(ctx context.Context, storage Storage, chatID int64, message *tg.Message, hash *mediaHash, chatSettings *ChatSettings, author *AuthorFilter) (*imageMatch, error) {
+	res := &imageMatch{}
+
+	candidates, err := storage.ListMatchingMessagesByImageHash(ctx, chatID, MediaTypePhoto, *hash.ImageHash, chatSettings.ImageHammingDistance, chatSettings.MinImageQuality, imageCandidatesLimit, author)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list matching messages by image hash: %w", err)
+	}
+
+	for i, c := range candidates {
+		dist, ok := detailDistance(hash.DetailHash, c.DetailHash)
+		if c.MessageID != message.MessageID && !isAlbumSibling(message, &c) && (!ok || dist <= chatSettings.TemplateDetailDistance+repostDetailMargin) {
+			res.Similar = append(res.Similar, &candidates[i])
+		}
+	}
+	if len(res.Similar) != 0 {
+		res.Repost = res.Similar[0]
+	}
+
+	frameMessage, err := storage.GetFirstMatchingMessageByFrameHash(ctx, chatID, *hash.ImageHash, chatSettings.ImageHammingDistance, chatSettings.MinImageQuality, author)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return nil, fmt.Errorf("unable to get first matching message by frame hash: %w", err)
+	}
+	if frameMessage != nil && frameMessage.MessageID != message.MessageID && !isAlbumSibling(message, frameMessage) {
+		res.Similar = append(res.Similar, frameMessage)
+		if res.Repost == nil || frameMessage.CreatedAt.Before(res.Repost.CreatedAt) {
+			res.Repost = frameMessage
+		}
+	}
+
+	if res.Repost != nil || len(hash.DetailHash) == 0 {
+		return res, nil
+	}
+
+	candidates, err = storage.ListMatchingMessagesByImageHash(ctx, chatID, MediaTypePhoto, *hash.ImageHash, chatSettings.TemplateHammingDistance, chatSettings.MinImageQuality, imageCandidatesLimit, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list template candidates by image hash: %w", err)
+	}
+
+	for i, c := range candidates {
+		dist, ok := detailDistance(hash.DetailHash, c.DetailHash)
+		if c.MessageID != message.MessageID && !isAlbumSibling(message, &c) && ok && dist > chatSettings.TemplateDetailDistance {
+			res.Template = &candidates[i]
+			res.ImageDistance = bits.OnesCount64(*hash.ImageHash ^ *c.ImageHash)
+			res.DetailDistance = dist
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// saveTemplateRelation links the message to the first image of the template,
+// so that every use of a template is counted together
+func saveTemplateRelation(ctx context.Context, storage Storage, message *tg.Message, match *imageMatch) error {
+	templateMessageID := match.Template.MessageID
+
+	relation, err := storage.GetTemplateRelation(ctx, message.Chat.ID, match.Template.MessageID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return fmt.Errorf("unable to get template relation: %w", err)
+	}
+	if err == nil {
+		templateMessageID = relation.TemplateMessageID
+	}
+
+	err = storage.UpsertTemplateRelation(ctx, TemplateRelation{
+		ChatID:            message.Chat.ID,
+		MessageID:         message.MessageID,
+		TemplateMessageID: templateMessageID,
+		ImageDistance:     match.ImageDistance,
+		DetailDistance:    match.DetailDistance,
+		CreatedAt:         time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save template relation: %w", err)
+	}
+
+	return nil
+}
+
+// messageLink links a message of a public chat or a supergroup, other chats have no message links
+func messageLink(chat tg.Chat, messageID int) string {
+	if chat.UserName != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.UserName, messageID)
+	}
+
+	id := strconv.FormatInt(chat.ID, 10)
+	if strings.HasPrefix(id, "-100") {
+		return fmt.Sprintf("https://t.me/c/%s/%d", strings.TrimPrefix(id, "-100"), messageID)
+	}
+
+	return fmt.Sprintf("#%d", messageID)
+}
+
+func (r *UpdateHandler) handleTemplates(ctx context.Context, storage Storage, message *tg.Message) error {
+	templates, err := storage.ListTopTemplates(ctx, message.Chat.ID, topTemplatesLimit)
+	if err != nil {
+		return fmt.Errorf("unable to list top templates: %w", err)
+	}
+
+	if len(templates) == 0 {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "шаблонов пока нет")
+		if err != nil {
+			return fmt.Errorf("unable to send no templates reply: %w", err)
+		}
+		return nil
+	}
+
+	var text strings.Builder
+	text.WriteString("Популярные шаблоны:")
+	for i, t := range templates {
+		fmt.Fprintf(&text, "\n%d. %s - новых вариантов: %d, последний %s",
+			i+1,
+			messageLink(message.Chat, t.TemplateMessageID),
+			t.Uses,
+			t.LastUsedAt.Format("02.01.2006"),
+		)
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, text.String())
+	if err != nil {
+		return fmt.Errorf("unable to send templates reply: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleChatSettingsTemplateHammingDistance(ctx context.Context, storage Storage, message *tg.Message) error {
+	dist, err := strconv.Atoi(strings.Trim(message.CommandArguments(), " "))
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть числом")
+		if err != nil {
+			return fmt.Errorf("unable to send int parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.TemplateHammingDistance = max(0, dist)
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
+
+// handleChatSettingsTemplateDetailDistance sets the detail distance from which photos of a template have a different text
+func (r *UpdateHandler) handleChatSettingsTemplateDetailDistance(ctx context.Context, storage Storage, message *tg.Message) error {
+	dist, err := strconv.Atoi(strings.Trim(message.CommandArguments(), " "))
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть числом")
+		if err != nil {
+			return fmt.Errorf("unable to send int parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.TemplateDetailDistance = max(0, dist)
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
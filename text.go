@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/NinaLeven/MemePolice/texthash"
+	tg "github.com/OvyFlash/telegram-bot-api"
+)
+
+// minCopypastaLength is the minimum length of normalized text to be fingerprinted,
+// shorter texts repeat naturally
+const minCopypastaLength = 150
+
+// textFingerprints are SimHash of long texts and captions and normalized links of a message
+type textFingerprints struct {
+	TextHash *uint64
+	URLs     []string
+}
+
+// getTextFingerprints resolves short links over the network, so it is called before the update transaction is open.
+func (r *UpdateHandler) getTextFingerprints(ctx context.Context, message *tg.Message) textFingerprints {
+	if message.IsCommand() || message.From == nil || message.From.ID == r.bot.Self.ID {
+		return textFingerprints{}
+	}
+
+	text, entities := message.Text, message.Entities
+	if text == "" {
+		text, entities = message.Caption, message.CaptionEntities
+	}
+
+	var textHash *uint64
+	if utf8.RuneCountInString(texthash.Normalize(text)) >= minCopypastaLength {
+		textHash = ptr(texthash.SimHash(text))
+	}
+
+	var urls []string
+	if rawURLs := extractURLs(text, entities); len(rawURLs) != 0 {
+		urls = texthash.NormalizeURLs(ctx, rawURLs)
+	}
+
+	return textFingerprints{
+		TextHash: textHash,
+		URLs:     urls,
+	}
+}
+
+// extractURLs returns links of url and text_link entities, entity offsets are in utf-16 code units.
+func extractURLs(text string, entities []tg.MessageEntity) []string {
+	var encoded []uint16
+
+	res := []string{}
+	for _, entity := range entities {
+		switch {
+		case entity.Type == "text_link" && entity.URL != "":
+			res = append(res, entity.URL)
+
+		case entity.IsURL():
+			if encoded == nil {
+				encoded = utf16.Encode([]rune(text))
+			}
+			if entity.Offset < 0 || entity.Offset+entity.Length > len(encoded) {
+				continue
+			}
+			res = append(res, string(utf16.Decode(encoded[entity.Offset:entity.Offset+entity.Length])))
+		}
+	}
+
+	return res
+}
+
+func (r *UpdateHandler) checkTextRepost(ctx context.Context, storage Storage, message *tg.Message, textHash *uint64, urls []string) error {
+	if textHash == nil && len(urls) == 0 {
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	kind, hash := fingerprint(nil, nil, nil, textHash)
+
+	banned, err := r.deleteBannedMeme(ctx, storage, message, chatSettings, kind, hash)
+	if err != nil {
+		return fmt.Errorf("unable to delete banned meme: %w", err)
+	}
+	if banned {
+		return nil
+	}
+
+	var origMessage *Message
+	author := selfRepostFilter(chatSettings, message)
+
+	if len(urls) != 0 {
+		origMessage, err = storage.GetFirstMatchingMessageByURLs(ctx, message.Chat.ID, urls, author)
+		if err != nil && !errors.Is(err, &ErrNotFound{}) {
+			return fmt.Errorf("unable to get first matching message by urls: %w", err)
+		}
+	}
+
+	if origMessage == nil && textHash != nil {
+		origMessage, err = storage.GetFirstMatchingMessageByTextHash(ctx, message.Chat.ID, *textHash, chatSettings.TextHammingDistance, author)
+		if err != nil && !errors.Is(err, &ErrNotFound{}) {
+			return fmt.Errorf("unable to get first matching message text hash: %w", err)
+		}
+	}
+
+	if origMessage == nil || origMessage.MessageID == message.MessageID {
+		return nil
+	}
+
+	err = r.reportRepost(ctx, storage, message, kind, hash, origMessage)
+	if err != nil {
+		return fmt.Errorf("unable to report repost: %w", err)
+	}
+
+	return nil
+}
+
+func (r *UpdateHandler) handleChatSettingsTextHammingDistance(ctx context.Context, storage Storage, message *tg.Message) error {
+	dist, err := strconv.Atoi(strings.Trim(message.CommandArguments(), " "))
+	if err != nil {
+		_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "аргумент должен быть числом")
+		if err != nil {
+			return fmt.Errorf("unable to send int parse error reply: %w", err)
+		}
+		return nil
+	}
+
+	chatSettings, err := r.getOrCreateChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get or create chat settings: %w", err)
+	}
+
+	chatSettings.TextHammingDistance = max(0, dist)
+
+	err = r.storage.UpsertChatSettings(ctx, *chatSettings)
+	if err != nil {
+		return fmt.Errorf("unable to update chat settings: %w", err)
+	}
+
+	err = r.sendOutChatSettings(ctx, storage, message.Chat.ID)
+	if err != nil {
+		return fmt.Errorf("unable to send out chat settings: %w", err)
+	}
+
+	return nil
+}
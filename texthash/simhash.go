@@ -0,0 +1,70 @@
+package texthash
+
+import (
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+// shingleSize is the number of words hashed together as one feature
+const shingleSize = 3
+
+// Normalize lowercases text, drops punctuation and collapses whitespace,
+// so formatting differences don't change the fingerprint.
+func Normalize(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+
+	space := true
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			space = false
+		case !space:
+			b.WriteRune(' ')
+			space = true
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// SimHash calculates a 64 bit SimHash of word shingles of the normalized text.
+// Near-duplicate texts have hashes within a small hamming distance, so texts are matched
+// with the same bktree hamming index as images. MinHash is not used: its signature is a vector
+// of minimums compared by the share of equal values, which that index can't search.
+func SimHash(text string) uint64 {
+	words := strings.Fields(Normalize(text))
+	if len(words) == 0 {
+		return 0
+	}
+
+	var weights [64]int
+
+	n := max(1, len(words)-shingleSize+1)
+	for i := 0; i < n; i++ {
+		shingle := strings.Join(words[i:min(len(words), i+shingleSize)], " ")
+
+		h := fnv.New64a()
+		h.Write([]byte(shingle))
+		feature := h.Sum64()
+
+		for bit := 0; bit < 64; bit++ {
+			if feature&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var res uint64
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			res |= 1 << bit
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,56 @@
+package texthash
+
+import (
+	"math/bits"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"  Hello,   World!  ", "hello world"},
+		{"Привет,\nМИР...", "привет мир"},
+		{"a-b_c 1.5", "a b c 1 5"},
+	}
+
+	for _, tt := range tests {
+		if got := Normalize(tt.text); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+const copypasta = "Я не читал эту пасту, но осуждаю каждого, кто её читал, потому что настоящие ценители мемов " +
+	"никогда не тратят время на тексты длиннее трёх строк и всегда ставят реакцию до прочтения"
+
+func TestSimHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		maxDist int
+		minDist int
+	}{
+		{"formatting", copypasta, "  " + copypasta + "!!!", 0, 0},
+		{"case", copypasta, "Я НЕ ЧИТАЛ ЭТУ ПАСТУ" + copypasta[len("Я не читал эту пасту"):], 0, 0},
+		{"one word changed", copypasta, copypasta[:len(copypasta)-len("прочтения")] + "чтения", 10, 0},
+		{"different text", copypasta, "совершенно другой текст про котиков, которые спят на клавиатуре и мешают работать весь день напролёт", 64, 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dist := bits.OnesCount64(SimHash(tt.a) ^ SimHash(tt.b))
+			if dist > tt.maxDist || dist < tt.minDist {
+				t.Errorf("distance = %d, want %d..%d", dist, tt.minDist, tt.maxDist)
+			}
+		})
+	}
+}
+
+func TestSimHashEmpty(t *testing.T) {
+	if got := SimHash(" ,.! "); got != 0 {
+		t.Errorf("SimHash() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,190 @@
+package texthash
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// trackingParams are query params that don't change the linked content
+var trackingParams = map[string]struct{}{
+	"fbclid":   {},
+	"gclid":    {},
+	"yclid":    {},
+	"igshid":   {},
+	"igsh":     {},
+	"si":       {},
+	"feature":  {},
+	"ref":      {},
+	"ref_src":  {},
+	"ref_url":  {},
+	"share_id": {},
+	"_r":       {},
+	"_t":       {},
+	"mc_cid":   {},
+	"mc_eid":   {},
+}
+
+var twitterHosts = map[string]struct{}{
+	"twitter.com":   {},
+	"x.com":         {},
+	"fxtwitter.com": {},
+	"vxtwitter.com": {},
+	"fixupx.com":    {},
+	"fixvx.com":     {},
+}
+
+// shortHosts only redirect to the real url and have to be resolved over the network
+var shortHosts = map[string]struct{}{
+	"t.co":          {},
+	"vm.tiktok.com": {},
+	"vt.tiktok.com": {},
+}
+
+// NormalizeURL brings a link to its canonical form: https scheme, host without www/m/mobile prefixes,
+// no fragment, no tracking params and sorted query. YouTube, X and TikTok links are reduced
+// to the content id so different short and share forms of the same post are equal.
+func NormalizeURL(rawURL string) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", fmt.Errorf("unable to parse url: %w", err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host: %s", rawURL)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, prefix := range []string{"www.", "m.", "mobile.", "music."} {
+		host = strings.TrimPrefix(host, prefix)
+	}
+
+	pth := strings.TrimRight(u.EscapedPath(), "/")
+	segments := strings.Split(strings.TrimPrefix(pth, "/"), "/")
+
+	switch {
+	case host == "youtu.be" && segments[0] != "":
+		return "https://youtube.com/watch?v=" + segments[0], nil
+
+	case host == "youtube.com" && len(segments) >= 2 && slices.Contains([]string{"shorts", "embed", "live", "v"}, segments[0]):
+		return "https://youtube.com/watch?v=" + segments[1], nil
+
+	case host == "youtube.com" && segments[0] == "watch" && u.Query().Get("v") != "":
+		return "https://youtube.com/watch?v=" + u.Query().Get("v"), nil
+
+	case isTwitterHost(host) && len(segments) >= 3 && segments[1] == "status":
+		return "https://x.com/" + strings.ToLower(segments[0]) + "/status/" + segments[2], nil
+
+	case host == "tiktok.com" && len(segments) >= 3 && segments[1] == "video":
+		return "https://tiktok.com/" + strings.ToLower(segments[0]) + "/video/" + segments[2], nil
+	}
+
+	query := u.Query()
+	for key := range query {
+		_, tracking := trackingParams[strings.ToLower(key)]
+		if tracking || strings.HasPrefix(strings.ToLower(key), "utm_") {
+			query.Del(key)
+		}
+	}
+
+	res := "https://" + host + pth
+	if len(query) != 0 {
+		// Encode sorts by key
+		res += "?" + query.Encode()
+	}
+
+	return res, nil
+}
+
+func isTwitterHost(host string) bool {
+	_, ok := twitterHosts[host]
+	return ok
+}
+
+// IsShortURL reports whether the link has to be resolved before normalization.
+func IsShortURL(rawURL string) bool {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return false
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host == "tiktok.com" && strings.HasPrefix(u.Path, "/t/") {
+		return true
+	}
+
+	_, ok := shortHosts[host]
+	return ok
+}
+
+const (
+	// resolveTimeout limits resolution of a single link
+	resolveTimeout = 3 * time.Second
+	// resolveTotalTimeout limits resolution of all links of a message, as messages are handled one by one
+	resolveTotalTimeout = 5 * time.Second
+)
+
+// ResolveURL follows redirects of short links (t.co, vm.tiktok.com and alike) and returns the final url.
+// Other links are returned as is.
+func ResolveURL(ctx context.Context, rawURL string) (string, error) {
+	if !IsShortURL(rawURL) {
+		return rawURL, nil
+	}
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve url: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return resp.Request.URL.String(), nil
+}
+
+// NormalizeURLs resolves and normalizes links dropping duplicates, links that fail to resolve
+// or are left when resolveTotalTimeout is out are normalized as is. Returns nil when there are no valid links.
+func NormalizeURLs(ctx context.Context, rawURLs []string) []string {
+	ctx, cancel := context.WithTimeout(ctx, resolveTotalTimeout)
+	defer cancel()
+
+	var res []string
+
+	for _, rawURL := range rawURLs {
+		resolved, err := ResolveURL(ctx, rawURL)
+		if err != nil {
+			resolved = rawURL
+		}
+
+		normalized, err := NormalizeURL(resolved)
+		if err != nil {
+			continue
+		}
+
+		if !slices.Contains(res, normalized) {
+			res = append(res, normalized)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,89 @@
+package texthash
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"no scheme", "example.com/a", "https://example.com/a"},
+		{"http", "http://example.com/a", "https://example.com/a"},
+		{"www and trailing slash", "https://www.Example.com/a/", "https://example.com/a"},
+		{"mobile", "https://m.example.com/a", "https://example.com/a"},
+		{"fragment", "https://example.com/a#top", "https://example.com/a"},
+		{"tracking params", "https://example.com/a?utm_source=tg&fbclid=1&id=2", "https://example.com/a?id=2"},
+		{"sorted query", "https://example.com/a?b=2&a=1", "https://example.com/a?a=1&b=2"},
+		{"youtu.be", "https://youtu.be/dQw4w9WgXcQ?si=abc", "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"youtube watch", "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=10", "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"youtube shorts", "https://youtube.com/shorts/dQw4w9WgXcQ", "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"youtube music", "https://music.youtube.com/watch?v=dQw4w9WgXcQ", "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"twitter", "https://twitter.com/User/status/123?s=20", "https://x.com/user/status/123"},
+		{"fxtwitter", "https://fxtwitter.com/user/status/123/photo/1", "https://x.com/user/status/123"},
+		{"mobile x", "https://mobile.x.com/user/status/123", "https://x.com/user/status/123"},
+		{"tiktok", "https://www.tiktok.com/@User/video/456?is_from_webapp=1", "https://tiktok.com/@user/video/456"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeURL(tt.url)
+			if err != nil {
+				t.Fatalf("NormalizeURL(%q) error = %v", tt.url, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeURL(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeURLError(t *testing.T) {
+	for _, url := range []string{"https://", "https://exa mple.com/%zz"} {
+		_, err := NormalizeURL(url)
+		if err == nil {
+			t.Errorf("NormalizeURL(%q) error = nil, want error", url)
+		}
+	}
+}
+
+func TestIsShortURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://t.co/abc", true},
+		{"vm.tiktok.com/abc", true},
+		{"https://vt.tiktok.com/abc", true},
+		{"https://www.tiktok.com/t/abc", true},
+		{"https://tiktok.com/@user/video/456", false},
+		{"https://example.com/a", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsShortURL(tt.url); got != tt.want {
+			t.Errorf("IsShortURL(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeURLs(t *testing.T) {
+	got := NormalizeURLs(context.Background(), []string{
+		"https://youtu.be/dQw4w9WgXcQ",
+		"https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+		"https://",
+		"example.com",
+	})
+	want := []string{"https://youtube.com/watch?v=dQw4w9WgXcQ", "https://example.com"}
+	if !slices.Equal(got, want) {
+		t.Errorf("NormalizeURLs() = %q, want %q", got, want)
+	}
+
+	if got := NormalizeURLs(context.Background(), []string{"https://"}); got != nil {
+		t.Errorf("NormalizeURLs() = %q, want nil", got)
+	}
+}
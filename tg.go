@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/NinaLeven/MemePolice/imageutils"
 	tg "github.com/OvyFlash/telegram-bot-api"
 	"go.uber.org/multierr"
 )
@@ -157,6 +158,11 @@ func (r *UpdateHandler) sendMessageReply(ctx context.Context,
 
 	msg, err := r.bot.Send(voice)
 	if err != nil {
+		if strings.Contains(err.Error(), "message to be replied not found") {
+			return 0, &ErrReplyTargetNotFound{
+				Err: fmt.Errorf("unable to send text message: %w", err),
+			}
+		}
 		if strings.Contains(err.Error(), "not found") {
 			return 0, &ErrNotFound{
 				Err: fmt.Errorf("unable to send text message: %w", err),
@@ -193,6 +199,33 @@ func (r *UpdateHandler) sendPhotoRepy(ctx context.Context,
 	return &msg, nil
 }
 
+func (r *UpdateHandler) sendDocumentReply(ctx context.Context,
+	chatID int64,
+	replyMessageID int,
+	name string,
+	data []byte,
+) (*tg.Message, error) {
+	document := tg.NewDocument(chatID, tg.FileBytes{
+		Name:  name,
+		Bytes: data,
+	})
+	document.ReplyParameters = tg.ReplyParameters{
+		MessageID: replyMessageID,
+	}
+
+	msg, err := r.bot.Send(document)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, &ErrNotFound{
+				Err: fmt.Errorf("unable to send document reply: %w", err),
+			}
+		}
+		return nil, fmt.Errorf("unable to send document reply: %w", err)
+	}
+
+	return &msg, nil
+}
+
 func (r *UpdateHandler) sendVideoRepy(ctx context.Context,
 	chatID int64,
 	replyMessageID int,
@@ -218,6 +251,31 @@ func (r *UpdateHandler) sendVideoRepy(ctx context.Context,
 	return &msg, nil
 }
 
+func (r *UpdateHandler) sendAnimationRepy(ctx context.Context,
+	chatID int64,
+	replyMessageID int,
+	text string,
+	fileID string,
+) (*tg.Message, error) {
+	animation := tg.NewAnimation(chatID, tg.FileID(fileID))
+	animation.Caption = text
+	animation.ReplyParameters = tg.ReplyParameters{
+		MessageID: replyMessageID,
+	}
+
+	msg, err := r.bot.Send(animation)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, &ErrNotFound{
+				Err: fmt.Errorf("unable to send animation reply: %w", err),
+			}
+		}
+		return nil, fmt.Errorf("unable to send animation reply: %w", err)
+	}
+
+	return &msg, nil
+}
+
 func (r *UpdateHandler) getTelegramImage(ctx context.Context, fileID string) (image.Image, error) {
 	fileReader, err := r.getTelegramFile(ctx, fileID)
 	if err != nil {
@@ -225,7 +283,7 @@ func (r *UpdateHandler) getTelegramImage(ctx context.Context, fileID string) (im
 	}
 	defer fileReader.Close()
 
-	img, _, err := image.Decode(fileReader)
+	img, _, err := imageutils.Decode(fileReader)
 	if err != nil {
 		return nil, fmt.Errorf("unable to decode image: %w", err)
 	}
@@ -347,3 +405,37 @@ func (r *UpdateHandler) sendSimplePoll(ctx context.Context,
 
 	return &msg, nil
 }
+
+func (r *UpdateHandler) isChatAdmin(_ context.Context, chatID, userID int64) (bool, error) {
+	member, err := r.bot.GetChatMember(tg.GetChatMemberConfig{
+		ChatConfigWithUser: tg.ChatConfigWithUser{
+			ChatConfig: tg.ChatConfig{
+				ChatID: chatID,
+			},
+			UserID: userID,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to get chat member: %w", err)
+	}
+
+	return member.IsCreator() || member.IsAdministrator(), nil
+}
+
+// checkAdmin replies to non admins that the command is for admins only
+func (r *UpdateHandler) checkAdmin(ctx context.Context, message *tg.Message) (bool, error) {
+	isAdmin, err := r.isChatAdmin(ctx, message.Chat.ID, message.From.ID)
+	if err != nil {
+		return false, fmt.Errorf("unable to check chat admin: %w", err)
+	}
+	if isAdmin {
+		return true, nil
+	}
+
+	_, err = r.sendMessageReply(ctx, message.Chat.ID, message.MessageID, "это может только админ")
+	if err != nil {
+		return false, fmt.Errorf("unable to send not admin reply: %w", err)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// tombstoneRetries is how many deleted originals in a row are skipped before giving up on a reply
+const tombstoneRetries = 3
+
+// replyToOrigin replies to the original of the cluster member. A tombstoned original is skipped, when the original
+// turns out deleted it is tombstoned and the reply goes to the next surviving message of the cluster.
+// The verdict is still told by the first message of the cluster, tombstoned or not.
+// Returns the reply id and the message replied to, ErrNotFound when no original survived.
+func (r *UpdateHandler) replyToOrigin(ctx context.Context, storage Storage, chatID int64, memberID int, origMsg *Message, text string) (int, *Message, error) {
+	if origMsg.DeletedAt != nil {
+		var err error
+		origMsg, err = r.getSurvivingOrigin(ctx, storage, chatID, memberID)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	for range tombstoneRetries {
+		replyID, err := r.sendMessageReply(ctx, chatID, origMsg.MessageID, text)
+		if err == nil {
+			return replyID, origMsg, nil
+		}
+		// other not found errors, e.g. of the chat, must not tombstone a live original
+		if !errors.Is(err, &ErrReplyTargetNotFound{}) {
+			return 0, nil, fmt.Errorf("unable to reply to original: %w", err)
+		}
+
+		slog.InfoContext(ctx, "original is deleted",
+			slog.Int64("chat_id", chatID),
+			slog.Int("message_id", origMsg.MessageID),
+		)
+
+		err = storage.MarkMessageDeleted(ctx, chatID, origMsg.MessageID, time.Now().UTC())
+		if err != nil {
+			return 0, nil, fmt.Errorf("unable to mark message deleted: %w", err)
+		}
+
+		origMsg, err = r.getSurvivingOrigin(ctx, storage, chatID, memberID)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return 0, nil, &ErrNotFound{}
+}
+
+// getSurvivingOrigin is ErrNotFound when the cluster member itself is the first surviving message
+func (r *UpdateHandler) getSurvivingOrigin(ctx context.Context, storage Storage, chatID int64, memberID int) (*Message, error) {
+	origMsg, err := storage.GetMemeClusterSurvivingOrigin(ctx, chatID, memberID)
+	if err != nil && !errors.Is(err, &ErrNotFound{}) {
+		return nil, fmt.Errorf("unable to get meme cluster surviving origin: %w", err)
+	}
+	if err != nil || origMsg.MessageID == memberID {
+		return nil, &ErrNotFound{}
+	}
+
+	return origMsg, nil
+}
@@ -265,6 +265,10 @@ func (r *UpdateHandler) sendTopkekChunk(ctx context.Context, storage Storage, to
 		case msg.Video != nil:
 			files = append(files, tg.NewInputMediaVideo(tg.FileID(msg.Video.FileID)))
 
+		case msg.Animation != nil:
+			// media groups don't accept animations, gifs are mp4 anyway
+			files = append(files, tg.NewInputMediaVideo(tg.FileID(msg.Animation.FileID)))
+
 		default:
 			continue
 		}
@@ -449,6 +453,17 @@ func (r *UpdateHandler) finishTopkek(ctx context.Context, storage Storage, topke
 		if err != nil {
 			return fmt.Errorf("unable to send winner video: %w", err)
 		}
+
+	case winnerMsg.Raw.Animation != nil:
+		winnerMsgRes, err = r.sendAnimationRepy(ctx,
+			topkek.ChatID,
+			winnerMsg.SourceMessageID,
+			fmt.Sprintf("Победитель %s", topkek.Name),
+			winnerMsg.Raw.Animation.FileID,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to send winner animation: %w", err)
+		}
 	}
 
 	err = storage.CreateTopkekMessage(ctx, TopkekMessage{
@@ -561,6 +576,9 @@ func (r *UpdateHandler) handlePreview(ctx context.Context, storage Storage, mess
 			case msg.Video != nil:
 				files = append(files, tg.NewInputMediaVideo(tg.FileID(msg.Video.FileID)))
 
+			case msg.Animation != nil:
+				files = append(files, tg.NewInputMediaVideo(tg.FileID(msg.Animation.FileID)))
+
 			default:
 				continue
 			}
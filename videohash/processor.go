@@ -1,44 +1,75 @@
 package videohash
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"image"
 	"log/slog"
+	"math/bits"
 	"os"
 	"path"
 
 	"github.com/NinaLeven/MemePolice/audiohash"
 	"github.com/NinaLeven/MemePolice/ffmpeg"
 	"github.com/NinaLeven/MemePolice/fsutils"
+	"github.com/NinaLeven/MemePolice/imageutils"
 
 	"github.com/corona10/goimagehash"
 )
 
-func PerceptualHash(videoPath string) (video uint64, audio uint64, err error) {
+type Hash struct {
+	Video uint64
+	Audio uint64
+	// FrameSelection is how frames were sampled, only hashes with the same selection are comparable
+	FrameSelection ffmpeg.FrameSelection
+	// Quality is the information score of the frames collage, see imageutils.Quality
+	Quality float64
+	// Frames are image hashes of distinct frames in order, comparable with image hashes of photos
+	Frames []uint64
+}
+
+// PerceptualHash returns video and audio hashes
+func PerceptualHash(ctx context.Context, videoPath string) (*Hash, error) {
 	tempDir, err := fsutils.GetTempDir()
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 	defer fsutils.CleanupTempDir(tempDir)
 
-	vh, err := perceptualVideoHash(tempDir, videoPath)
+	h, err := perceptualVideoHash(ctx, tempDir, videoPath)
 	if err != nil {
-		return 0, 0, fmt.Errorf("unable to calculate video phash: %w", err)
+		return nil, fmt.Errorf("unable to calculate video phash: %w", err)
 	}
 
-	ah, err := perceptualAudioHash(tempDir, videoPath)
+	h.Audio, err = perceptualAudioHash(ctx, tempDir, videoPath)
 	if err != nil {
-		return 0, 0, fmt.Errorf("unable to calculate audio phash: %w", err)
+		return nil, fmt.Errorf("unable to calculate audio phash: %w", err)
 	}
 
-	return vh, ah, err
+	return h, nil
 }
 
-func perceptualAudioHash(tempDir, videoPath string) (uint64, error) {
+// PerceptualVideoHash returns the frames hash only, audio hash is always 0
+func PerceptualVideoHash(ctx context.Context, videoPath string) (*Hash, error) {
+	tempDir, err := fsutils.GetTempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer fsutils.CleanupTempDir(tempDir)
+
+	h, err := perceptualVideoHash(ctx, tempDir, videoPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to calculate video phash: %w", err)
+	}
+
+	return h, nil
+}
+
+func perceptualAudioHash(ctx context.Context, tempDir, videoPath string) (uint64, error) {
 	audioPath := path.Join(tempDir, path.Base(videoPath)+".mp3")
 
-	err := ffmpeg.ExtractAudio(videoPath, audioPath)
+	err := ffmpeg.ExtractAudio(ctx, videoPath, audioPath)
 	if err != nil && !errors.Is(err, &ffmpeg.ErrNoAudio{}) {
 		return 0, fmt.Errorf("unable to extract audio: %w", err)
 	}
@@ -47,7 +78,7 @@ func perceptualAudioHash(tempDir, videoPath string) (uint64, error) {
 		return 0, nil
 	}
 
-	h, err := audiohash.PerceptualHash(audioPath)
+	h, err := audiohash.PerceptualHash(ctx, audioPath)
 	if err != nil {
 		return 0, fmt.Errorf("unable to calculate audio phash: %w", err)
 	}
@@ -55,52 +86,115 @@ func perceptualAudioHash(tempDir, videoPath string) (uint64, error) {
 	return h, nil
 }
 
-const expectedFramesCount = 12
+const (
+	expectedFramesCount = 12
+	// with fewer scene changes the video is considered static and sampled by time
+	minSceneFramesCount = 4
+	// frames closer than that to an already kept frame are the same picture re-encoded
+	sameFrameDistance = 2
+)
+
+// FrameSelection is the configured way to sample frames: nth by default,
+// scene detection is enabled with VIDEO_FRAME_SELECTION=scene
+func FrameSelection() ffmpeg.FrameSelection {
+	if os.Getenv("VIDEO_FRAME_SELECTION") == string(ffmpeg.FrameSelectionScene) {
+		return ffmpeg.FrameSelectionScene
+	}
+	return ffmpeg.FrameSelectionNth
+}
+
+func perceptualVideoHash(ctx context.Context, tempDir, videoPath string) (*Hash, error) {
+	selection := FrameSelection()
 
-func perceptualVideoHash(tempDir, videoPath string) (uint64, error) {
-	framesDir := path.Join(tempDir, "frames")
+	frames, err := extractFrames(ctx, tempDir, videoPath, selection)
+	if err != nil && !(selection == ffmpeg.FrameSelectionScene && errors.Is(err, &ffmpeg.ErrNoFrames{})) {
+		return nil, fmt.Errorf("unable to extract frames: %w", err)
+	}
 
-	err := os.Mkdir(framesDir, os.ModeDir|os.ModePerm)
-	if err != nil {
-		return 0, fmt.Errorf("unable to create frames dir: %w", err)
+	// static videos are sampled by time and their hashes are stored as fps, as they are not comparable with scene ones
+	if selection == ffmpeg.FrameSelectionScene && len(frames) < minSceneFramesCount {
+		selection = ffmpeg.FrameSelectionFPS
+
+		frames, err = extractFrames(ctx, tempDir, videoPath, selection)
+		if err != nil {
+			return nil, fmt.Errorf("unable to extract frames: %w", err)
+		}
 	}
 
-	framesFilenames, err := ffmpeg.ExtractFrames(videoPath, framesDir, expectedFramesCount)
+	collage, err := createCollage(frames)
 	if err != nil {
-		return 0, fmt.Errorf("unable to extract frames: %w", err)
+		return nil, fmt.Errorf("unable to create collage: %w", err)
 	}
 
-	collagePath := path.Join(tempDir, "collage.png")
-
-	err = createCollage(framesFilenames, collagePath)
+	phash, err := goimagehash.PerceptionHash(collage)
 	if err != nil {
-		return 0, fmt.Errorf("unable to create collage: %w", err)
+		return nil, fmt.Errorf("unable to calculate hash: %w", err)
 	}
 
-	h, err := imagePHash(collagePath)
+	framesHashes, err := distinctFramesHashes(frames)
 	if err != nil {
-		return 0, fmt.Errorf("unable to calc phash: %w", err)
+		return nil, fmt.Errorf("unable to calculate frames hashes: %w", err)
 	}
 
-	return h, err
+	return &Hash{
+		Video:          phash.GetHash(),
+		FrameSelection: selection,
+		Quality:        imageutils.Quality(collage),
+		Frames:         framesHashes,
+	}, nil
 }
 
-func imagePHash(imagePath string) (uint64, error) {
-	input, err := os.Open(imagePath)
-	if err != nil {
-		return 0, fmt.Errorf("unable to open image file: %w", err)
+func distinctFramesHashes(frames []image.Image) ([]uint64, error) {
+	res := make([]uint64, 0, len(frames))
+
+	for _, frame := range frames {
+		phash, err := goimagehash.PerceptionHash(frame)
+		if err != nil {
+			return nil, err
+		}
+
+		h := phash.GetHash()
+
+		distinct := true
+		for _, kept := range res {
+			if bits.OnesCount64(h^kept) <= sameFrameDistance {
+				distinct = false
+				break
+			}
+		}
+		if distinct {
+			res = append(res, h)
+		}
 	}
-	defer input.Close()
 
-	img, _, err := image.Decode(input)
+	return res, nil
+}
+
+// extractFrames streams frames from ffmpeg, falling back to png files if streaming is not possible
+func extractFrames(ctx context.Context, tempDir, videoPath string, selection ffmpeg.FrameSelection) ([]image.Image, error) {
+	rgbFrames, err := ffmpeg.ExtractFramesRGB(ctx, videoPath, selection, expectedFramesCount)
+	if errors.Is(err, &ffmpeg.ErrNoFrames{}) {
+		return nil, err
+	}
+	if err == nil {
+		frames := make([]image.Image, 0, len(rgbFrames))
+		for _, f := range rgbFrames {
+			frames = append(frames, f)
+		}
+		return frames, nil
+	}
+
+	slog.Warn("unable to stream frames, falling back to files", slog.String("err", err.Error()))
+
+	framesDir, err := os.MkdirTemp(tempDir, "frames")
 	if err != nil {
-		return 0, fmt.Errorf("unbale to decode image: %w", err)
+		return nil, fmt.Errorf("unable to create frames dir: %w", err)
 	}
 
-	phash, err := goimagehash.PerceptionHash(img)
+	framesFilenames, err := ffmpeg.ExtractFrames(ctx, videoPath, framesDir, selection, expectedFramesCount)
 	if err != nil {
-		return 0, fmt.Errorf("unable to calculate hash: %w", err)
+		return nil, err
 	}
 
-	return phash.GetHash(), nil
+	return loadFrames(framesFilenames)
 }
@@ -0,0 +1,59 @@
+package videohash
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/NinaLeven/MemePolice/ffmpeg"
+)
+
+// testdata/clip.y4m is a 64x36 3s 12fps clip with a moving box and a background changing twice a second
+
+func skipWithoutFFmpeg(b *testing.B) {
+	b.Helper()
+
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		_, err := exec.LookPath(name)
+		if err != nil {
+			b.Skipf("%s is not installed", name)
+		}
+	}
+}
+
+// BenchmarkExtractFramesPNG is the file based path: frames are written as png files and decoded back
+func BenchmarkExtractFramesPNG(b *testing.B) {
+	skipWithoutFFmpeg(b)
+	ctx := context.Background()
+
+	for range b.N {
+		framesDir, err := os.MkdirTemp(b.TempDir(), "frames")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		framesFilenames, err := ffmpeg.ExtractFrames(ctx, "testdata/clip.y4m", framesDir, ffmpeg.FrameSelectionNth, expectedFramesCount)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = loadFrames(framesFilenames)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExtractFramesRGB is the streaming path: frames are read from ffmpeg stdout as raw rgb24
+func BenchmarkExtractFramesRGB(b *testing.B) {
+	skipWithoutFFmpeg(b)
+	ctx := context.Background()
+
+	for range b.N {
+		_, err := ffmpeg.ExtractFramesRGB(ctx, "testdata/clip.y4m", ffmpeg.FrameSelectionNth, expectedFramesCount)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}